@@ -1,8 +1,18 @@
 package forwardproxy
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
 /*
@@ -196,3 +206,326 @@ func TestBlacklistAllowing(t *testing.T) {
 		}
 	}
 }
+
+func TestConnectHostPattern(t *testing.T) {
+	const useTLS = true
+	for _, httpProxyVer := range testHTTPProxyVersions {
+		for _, httpTargetVer := range testHTTPTargetVersions {
+			for _, resource := range testResources {
+				response, err := connectAndGetViaProxy(caddyTestTarget.addr, resource, caddyForwardProxyConnectHostPattern.addr, httpTargetVer, credentialsEmpty, httpProxyVer, useTLS)
+				if err != nil {
+					t.Fatal(err)
+				} else if err = responseExpected(response, caddyTestTarget.contents[resource]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, httpProxyVer := range testHTTPProxyVersions {
+		for _, httpTargetVer := range testHTTPTargetVersions {
+			for _, resource := range testResources {
+				response, err := connectAndGetViaProxy(caddyHTTPTestTarget.addr, resource, caddyForwardProxyConnectHostPattern.addr, httpTargetVer, credentialsEmpty, httpProxyVer, useTLS)
+				if err != nil {
+					t.Fatal(err)
+				} else if response.StatusCode != http.StatusBadRequest {
+					t.Fatal("Expected response \"400 Bad Request\", got:", response.StatusCode)
+				}
+			}
+		}
+	}
+}
+
+func TestDangerousPortsBlocking(t *testing.T) {
+	const useTLS = true
+	for _, httpProxyVer := range testHTTPProxyVersions {
+		for _, resource := range testResources {
+			response, err := getViaProxy("127.0.64.51:25", resource, caddyForwardProxyDangerousPorts.addr, httpProxyVer,
+				"", useTLS)
+			if err != nil {
+				t.Fatal(err)
+			} else if response.StatusCode != http.StatusForbidden {
+				t.Fatal("Expected response \"403 Forbidden\", got:", response.StatusCode)
+			}
+		}
+	}
+
+	for _, httpProxyVer := range testHTTPProxyVersions {
+		for _, httpTargetVer := range testHTTPTargetVersions {
+			response, err := connectAndGetViaProxy("127.0.64.51:25", "/", caddyForwardProxyDangerousPorts.addr,
+				httpTargetVer, credentialsEmpty, httpProxyVer, useTLS)
+			if err != nil {
+				t.Fatal(err)
+			} else if response.StatusCode != http.StatusForbidden {
+				t.Fatal("Expected response \"403 Forbidden\", got:", response.StatusCode)
+			}
+		}
+	}
+
+	for _, httpProxyVer := range testHTTPProxyVersions {
+		for _, resource := range testResources {
+			response, err := getViaProxy(caddyTestTarget.addr, resource, caddyForwardProxyDangerousPorts.addr, httpProxyVer,
+				"", useTLS)
+			if err != nil {
+				t.Fatal(err)
+			} else if err = responseExpected(response, caddyTestTarget.contents[resource]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestDangerousPortsAllowed(t *testing.T) {
+	h := Handler{BlockDangerousPorts: true, DangerousPorts: defaultDangerousPorts}
+	if h.portIsAllowed("25") {
+		t.Fatal("port 25 is expected to be blocked")
+	}
+	if h.portIsAllowed("0") {
+		t.Fatal("port 0 is expected to be blocked")
+	}
+	if !h.portIsAllowed("443") {
+		t.Fatal("port 443 is expected to be allowed")
+	}
+
+	h.AllowedPorts = []int{25, 443}
+	if !h.portIsAllowed("25") {
+		t.Fatal("explicitly allowed port 25 is expected to be allowed")
+	}
+
+	h = Handler{BlockDangerousPorts: true, DangerousPorts: []int{443}}
+	if h.portIsAllowed("443") {
+		t.Fatal("port 443 from overridden list is expected to be blocked")
+	}
+	if !h.portIsAllowed("25") {
+		t.Fatal("port 25 is expected to be allowed with overridden list")
+	}
+}
+
+func TestDangerousPortsConnect(t *testing.T) {
+	dialed := false
+	h := &Handler{
+		logger:              zap.NewNop(),
+		accessLogger:        zap.NewNop(),
+		BlockDangerousPorts: true,
+		DangerousPorts:      defaultDangerousPorts,
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = true
+			return nil, errors.New("unexpected dial")
+		},
+	}
+	w := httptest.NewRecorder()
+	err := h.ServeHTTP(w, newTestRequest(http.MethodConnect, "example.com:25"), nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusForbidden {
+		t.Fatal("expected CONNECT to a dangerous port to be rejected with 403, got:", err)
+	}
+	if w.Flushed {
+		t.Fatal("expected CONNECT to a dangerous port to be rejected before fast open")
+	}
+	if dialed {
+		t.Fatal("expected CONNECT to a dangerous port not to be dialed")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	const useTLS = true
+	for _, httpProxyVer := range testHTTPProxyVersions {
+		for _, httpTargetVer := range testHTTPTargetVersions {
+			for _, resource := range testResources {
+				response, err := connectAndGetViaProxy("testtarget:443", resource, caddyForwardProxyAliases.addr, httpTargetVer, credentialsEmpty, httpProxyVer, useTLS)
+				if err != nil {
+					t.Fatal(err)
+				} else if err = responseExpected(response, caddyTestTarget.contents[resource]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, httpProxyVer := range testHTTPProxyVersions {
+		for _, httpTargetVer := range testHTTPTargetVersions {
+			for _, resource := range testResources {
+				response, err := connectAndGetViaProxy(caddyTestTarget.addr, resource, caddyForwardProxyAliases.addr, httpTargetVer, credentialsEmpty, httpProxyVer, useTLS)
+				if err != nil {
+					t.Fatal(err)
+				} else if response.StatusCode != http.StatusNotFound {
+					t.Fatal("Expected response \"404 Not Found\", got:", response.StatusCode)
+				}
+			}
+		}
+	}
+}
+
+func TestResolveAlias(t *testing.T) {
+	h := Handler{Aliases: map[string]string{
+		"short":     "real.example.com:8443",
+		"short:80":  "other.example.com:8080",
+		"[::1]:443": "ipv6.example.com:443",
+	}}
+	for _, test := range []struct {
+		hostPort string
+		target   string
+		ok       bool
+	}{
+		{hostPort: "short:443", target: "real.example.com:8443", ok: true},
+		{hostPort: "short:80", target: "other.example.com:8080", ok: true},
+		{hostPort: "[::1]:443", target: "ipv6.example.com:443", ok: true},
+		{hostPort: "unknown:443", ok: false},
+		{hostPort: "real.example.com:8443", ok: false},
+	} {
+		target, ok := h.resolveAlias(test.hostPort)
+		if target != test.target || ok != test.ok {
+			t.Fatalf("resolveAlias(%s): expected (%s, %v), got (%s, %v)", test.hostPort, test.target, test.ok, target, ok)
+		}
+	}
+}
+
+func TestEgressRuleFor(t *testing.T) {
+	h := Handler{}
+	for _, ea := range []EgressAddress{
+		{LocalAddress: "192.0.2.10", Targets: []string{"*.example.com", "198.51.100.0/24"}},
+		{LocalAddress: "192.0.2.20", Targets: []string{"all"}},
+		{LocalAddress: "2001:db8::10", Targets: []string{"example.com"}},
+	} {
+		er := egressRule{localIP: net.ParseIP(ea.LocalAddress)}
+		for _, subj := range ea.Targets {
+			ar, err := newACLRule(subj, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			er.targets = append(er.targets, ar)
+		}
+		h.egressRules = append(h.egressRules, er)
+	}
+
+	for _, test := range []struct {
+		hostname string
+		ip       string
+		localIP  string
+	}{
+		{hostname: "www.example.com", ip: "203.0.113.1", localIP: "192.0.2.10"},
+		{hostname: "198.51.100.7", ip: "198.51.100.7", localIP: "192.0.2.10"},
+		{hostname: "caddyserver.com", ip: "203.0.113.2", localIP: "192.0.2.20"},
+		{hostname: "example.com", ip: "2001:db8:1::1", localIP: "2001:db8::10"},
+		{hostname: "caddyserver.com", ip: "2001:db8:1::2", localIP: ""},
+	} {
+		er := h.egressRuleFor(test.hostname, net.ParseIP(test.ip))
+		if test.localIP == "" {
+			if er != nil {
+				t.Fatalf("%s (%s): expected no egress rule, got local address %s", test.hostname, test.ip, er.localIP)
+			}
+			continue
+		}
+		if er == nil || !er.localIP.Equal(net.ParseIP(test.localIP)) {
+			t.Fatalf("%s (%s): expected local address %s, got: %+v", test.hostname, test.ip, test.localIP, er)
+		}
+	}
+}
+
+func TestEgressDialing(t *testing.T) {
+	var dialedFrom string
+	stubDialer := func(localAddr string) func(ctx context.Context, network, address string) (net.Conn, error) {
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialedFrom = localAddr
+			return nil, errors.New("test dial")
+		}
+	}
+	egressTarget, err := newACLRule("*.example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler{
+		aclRules:    []aclRule{&aclAllRule{allow: true}},
+		resolver:    &countingResolver{},
+		dialContext: stubDialer("default"),
+		egressRules: []egressRule{
+			{localIP: net.ParseIP("192.0.2.10"), targets: []aclRule{egressTarget}, dialContext: stubDialer("192.0.2.10")},
+		},
+	}
+	for hostPort, expected := range map[string]string{
+		"www.example.com:443": "192.0.2.10",
+		"caddyserver.com:443": "default",
+	} {
+		h.dialContextCheckACL(context.Background(), "tcp", hostPort)
+		if dialedFrom != expected {
+			t.Fatalf("%s: expected to dial from %s, dialed from %s", hostPort, expected, dialedFrom)
+		}
+	}
+}
+
+func TestDenySelf(t *testing.T) {
+	localAddrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("203.0.113.5"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(64, 128)},
+		&net.IPAddr{IP: net.ParseIP("198.51.100.1")}, // not an interface address
+	}
+	var dialed string
+	h := Handler{
+		aclRules: append(selfDenyRules(localAddrs), &aclAllRule{allow: true}),
+		// the cache passes IP addresses through, and resolves hostnames to 192.0.2.1
+		resolver: newDNSCache(&countingResolver{}, time.Minute),
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = address
+			return nil, errors.New("test dial")
+		},
+	}
+	for hostPort, denied := range map[string]bool{
+		"203.0.113.5:443":   true,
+		"[2001:db8::5]:443": true,
+		"0.0.0.0:443":       true,
+		"[::]:443":          true,
+		"203.0.113.6:443":   false, // same network, different host
+		"[2001:db8::6]:443": false,
+		"198.51.100.1:443":  false,
+		"example.com:443":   false,
+	} {
+		dialed = ""
+		_, err := h.dialContextCheckACL(context.Background(), "tcp", hostPort)
+		herr, _ := err.(caddyhttp.HandlerError)
+		if denied && (herr.StatusCode != http.StatusForbidden || dialed != "") {
+			t.Fatalf("%s: expected connection to local address to be denied, got: %v", hostPort, err)
+		}
+		if !denied && dialed == "" {
+			t.Fatalf("%s: expected connection to be allowed, got: %v", hostPort, err)
+		}
+	}
+}
+
+func TestExpandList(t *testing.T) {
+	os.Setenv("FORWARDPROXY_TEST_HOSTS", " *.example.com, 192.0.2.0/24 ,")
+	defer os.Unsetenv("FORWARDPROXY_TEST_HOSTS")
+
+	entries, err := expandList([]string{"caddyserver.com", "{env.FORWARDPROXY_TEST_HOSTS}"})
+	expected := []string{"caddyserver.com", "*.example.com", "192.0.2.0/24"}
+	if err != nil || !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected %v, got: %v, %v", expected, entries, err)
+	}
+	if _, err := expandList([]string{"caddyserver.com", "{env.FORWARDPROXY_TEST_UNSET}"}); err == nil {
+		t.Fatal("expected entry that expands to nothing to be an error")
+	}
+
+	var rules []aclRule
+	for _, subj := range entries {
+		ar, err := newACLRule(subj, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, ar)
+	}
+	for _, test := range []struct {
+		ip       string
+		hostname string
+	}{
+		{ip: "203.0.113.1", hostname: "www.example.com"},
+		{ip: "192.0.2.7", hostname: "192.0.2.7"},
+	} {
+		denied := false
+		for _, rule := range rules {
+			if rule.tryMatch(net.ParseIP(test.ip), test.hostname) == aclDecisionDeny {
+				denied = true
+			}
+		}
+		if !denied {
+			t.Fatalf("%s (%s): expected expanded rules to apply", test.hostname, test.ip)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package forwardproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// AuthzService configures an external HTTP service that authorizes proxy requests.
+// For every request, the service receives a POST with a JSON body like
+// {"target": "example.com:443", "client_ip": "203.0.113.7"}. A 2xx response allows
+// the request, a 4xx response denies it, and anything else is a failure.
+type AuthzService struct {
+	// URL of the service.
+	URL string `json:"url,omitempty"`
+
+	// How long to wait for the service. Default: 2s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// How long decisions are cached per client IP and target. Default: 5s.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// If true, requests are allowed when the service fails; otherwise they are rejected.
+	FailOpen bool `json:"fail_open,omitempty"`
+
+	client *http.Client
+
+	mu        sync.Mutex
+	decisions map[authzRequest]authzDecision
+}
+
+// Expired decisions are purged once the cache grows beyond this size.
+const authzCachePurgeSize = 4096
+
+type authzRequest struct {
+	Target   string `json:"target"`
+	ClientIP string `json:"client_ip"`
+}
+
+type authzDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+func (a *AuthzService) provision() error {
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return fmt.Errorf("bad authz service URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("authz service URL must be http or https, got: %s", a.URL)
+	}
+	if a.Timeout <= 0 {
+		a.Timeout = caddy.Duration(2 * time.Second)
+	}
+	if a.CacheTTL <= 0 {
+		a.CacheTTL = caddy.Duration(5 * time.Second)
+	}
+	a.client = &http.Client{Timeout: time.Duration(a.Timeout)}
+	a.decisions = make(map[authzRequest]authzDecision)
+	return nil
+}
+
+// authorize asks the service whether clientIP may connect to target.
+// Returns an error if the service fails, regardless of FailOpen.
+func (a *AuthzService) authorize(ctx context.Context, clientIP, target string) (bool, error) {
+	req := authzRequest{Target: target, ClientIP: clientIP}
+
+	now := time.Now()
+	a.mu.Lock()
+	decision, ok := a.decisions[req]
+	a.mu.Unlock()
+	if ok && now.Before(decision.expires) {
+		return decision.allowed, nil
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		decision.allowed = true
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		decision.allowed = false
+	default:
+		return false, fmt.Errorf("authz service responded with %s", resp.Status)
+	}
+	decision.expires = now.Add(time.Duration(a.CacheTTL))
+
+	a.mu.Lock()
+	if len(a.decisions) >= authzCachePurgeSize {
+		for r, d := range a.decisions {
+			if !now.Before(d.expires) {
+				delete(a.decisions, r)
+			}
+		}
+	}
+	a.decisions[req] = decision
+	a.mu.Unlock()
+
+	return decision.allowed, nil
+}
+
+// checkAuthzService asks the authz service, if configured, whether r may be proxied to hostPort.
+func (h Handler) checkAuthzService(r *http.Request, hostPort string) error {
+	if h.AuthzService == nil {
+		return nil
+	}
+	allowed, err := h.AuthzService.authorize(r.Context(), h.clientIP(r).String(), hostPort)
+	if err != nil {
+		if h.AuthzService.FailOpen {
+			h.logger.Warn("authz service failed, allowing request",
+				zap.String("target", hostPort),
+				zap.Error(err))
+			return nil
+		}
+		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("authz service failed: %v", err))
+	}
+	if !allowed {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("authz service denied access to %s", hostPort))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package forwardproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// newAuthzServer starts a stub authz service allowing only allowed.example.com:443.
+func newAuthzServer(t *testing.T, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		var req authzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.ClientIP != "203.0.113.7" {
+			t.Errorf("unexpected client IP: %s", req.ClientIP)
+		}
+		if req.Target == "allowed.example.com:443" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+}
+
+func TestAuthzService(t *testing.T) {
+	var requests int32
+	srv := newAuthzServer(t, &requests)
+	defer srv.Close()
+
+	a := &AuthzService{URL: srv.URL}
+	if err := a.provision(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		allowed, err := a.authorize(context.Background(), "203.0.113.7", "allowed.example.com:443")
+		if err != nil || !allowed {
+			t.Fatalf("expected allowed target to be allowed, got: %v %v", allowed, err)
+		}
+		allowed, err = a.authorize(context.Background(), "203.0.113.7", "denied.example.com:443")
+		if err != nil || allowed {
+			t.Fatalf("expected denied target to be denied, got: %v %v", allowed, err)
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("expected decisions to be cached, but service got %d requests", requests)
+	}
+}
+
+func TestAuthzServiceConnect(t *testing.T) {
+	var requests int32
+	srv := newAuthzServer(t, &requests)
+	defer srv.Close()
+
+	h := &Handler{logger: zap.NewNop(), AuthzService: &AuthzService{URL: srv.URL}}
+	if err := h.AuthzService.provision(); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRequest(http.MethodConnect, "denied.example.com:443")
+	r.RemoteAddr = "203.0.113.7:5555"
+	err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusForbidden {
+		t.Fatal("expected 403 error, got:", err)
+	}
+}
+
+func TestAuthzServiceFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	for _, failOpen := range []bool{false, true} {
+		h := Handler{logger: zap.NewNop(), AuthzService: &AuthzService{URL: srv.URL, FailOpen: failOpen}}
+		if err := h.AuthzService.provision(); err != nil {
+			t.Fatal(err)
+		}
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		err := h.checkAuthzService(r, "example.com:443")
+		if failOpen && err != nil {
+			t.Fatal("expected failing service to allow request with fail_open, got:", err)
+		}
+		if herr, ok := err.(caddyhttp.HandlerError); !failOpen && (!ok || herr.StatusCode != http.StatusServiceUnavailable) {
+			t.Fatal("expected failing service to reject request with 503, got:", err)
+		}
+	}
+}
@@ -71,20 +71,98 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			for i, p := range args {
 				intPort, err := strconv.Atoi(p)
 				if intPort <= 0 || intPort > 65535 || err != nil {
-					return d.Errf("ports are expected to be space-separated and in 0-65535 range, but got: %s", p)
+					return d.Errf("ports are expected to be space-separated and in 1-65535 range, but got: %s", p)
 				}
 				h.AllowedPorts[i] = intPort
 			}
+		case "block_dangerous_ports":
+			if h.BlockDangerousPorts {
+				return d.Err("block_dangerous_ports subdirective specified twice")
+			}
+			h.BlockDangerousPorts = true
+			for _, p := range args {
+				intPort, err := strconv.Atoi(p)
+				if intPort < 0 || intPort > 65535 || err != nil {
+					return d.Errf("ports are expected to be space-separated and in 0-65535 range, but got: %s", p)
+				}
+				h.DangerousPorts = append(h.DangerousPorts, intPort)
+			}
+		case "trusted_proxies":
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			h.TrustedProxies = append(h.TrustedProxies, args...)
+		case "allow_clients":
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			h.AllowClients = append(h.AllowClients, args...)
 		case "hide_ip":
 			if len(args) != 0 {
 				return d.ArgErr()
 			}
 			h.HideIP = true
+		case "log_tunnels":
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.LogTunnels = true
+		case "log_client_hostname":
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.LogClientHostname = true
+		case "require_sni_match":
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.RequireSNIMatch = true
+		case "deny_self":
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.DenySelf = true
+		case "strip_userinfo":
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.StripUserinfo = true
 		case "hide_via":
 			if len(args) != 0 {
 				return d.ArgErr()
 			}
 			h.HideVia = true
+		case "only_alpn":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if h.OnlyALPN != "" {
+				return d.Err("only_alpn subdirective specified twice")
+			}
+			h.OnlyALPN = args[0]
+		case "server_header":
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			if h.ServerHeader != nil {
+				return d.Err("server_header subdirective specified twice")
+			}
+			server := ""
+			if len(args) == 1 {
+				server = args[0]
+			}
+			h.ServerHeader = &server
+		case "min_tls_version":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if h.MinTLSVersion != "" {
+				return d.Err("min_tls_version subdirective specified twice")
+			}
+			if _, err := parseTLSVersion(args[0]); err != nil {
+				return d.Err(err.Error())
+			}
+			h.MinTLSVersion = args[0]
 		case "probe_resistance":
 			if len(args) > 1 {
 				return d.ArgErr()
@@ -98,6 +176,26 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			} else {
 				h.ProbeResistance = &ProbeResistance{}
 			}
+		case "random_delay":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			delay, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.ArgErr()
+			}
+			if delay <= 0 {
+				return d.Err("random_delay must be positive.")
+			}
+			h.RandomDelay = caddy.Duration(delay)
+		case "name":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if h.Name != "" {
+				return d.Err("name subdirective specified twice")
+			}
+			h.Name = args[0]
 		case "serve_pac":
 			if len(args) > 1 {
 				return d.ArgErr()
@@ -125,6 +223,187 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Err("dial_timeout cannot be negative.")
 			}
 			h.DialTimeout = caddy.Duration(timeout)
+		case "read_timeout", "write_timeout":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.ArgErr()
+			}
+			if timeout <= 0 {
+				return d.Errf("%s must be positive.", subdirective)
+			}
+			if subdirective == "read_timeout" {
+				h.ReadTimeout = caddy.Duration(timeout)
+			} else {
+				h.WriteTimeout = caddy.Duration(timeout)
+			}
+		case "max_buffered_body":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			size, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || size <= 0 {
+				return d.Errf("max_buffered_body expects a positive number of bytes, got: %s", args[0])
+			}
+			h.MaxBufferedBody = size
+		case "max_tunnels":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return d.Errf("max_tunnels expects a positive number, got: %s", args[0])
+			}
+			h.MaxTunnels = n
+		case "max_targets_per_client":
+			if len(args) != 1 && len(args) != 2 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return d.Errf("max_targets_per_client expects a positive number, got: %s", args[0])
+			}
+			h.MaxTargetsPerClient = n
+			if len(args) == 2 {
+				window, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return d.Err(err.Error())
+				}
+				if window <= 0 {
+					return d.Err("max_targets_per_client window must be positive.")
+				}
+				h.TargetsWindow = caddy.Duration(window)
+			}
+		case "max_pending_handshakes":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return d.Errf("max_pending_handshakes expects a positive number, got: %s", args[0])
+			}
+			h.MaxPendingHandshakes = n
+		case "max_bytes":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			size, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || size <= 0 {
+				return d.Errf("max_bytes expects a positive number of bytes, got: %s", args[0])
+			}
+			h.MaxBytes = size
+		case "tcp_nodelay":
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			noDelay := true
+			if len(args) == 1 {
+				switch args[0] {
+				case "on":
+				case "off":
+					noDelay = false
+				default:
+					return d.Errf("tcp_nodelay expects on or off, got: %s", args[0])
+				}
+			}
+			h.TCPNoDelay = &noDelay
+		case "tcp_keepalive":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			period, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.ArgErr()
+			}
+			if period <= 0 {
+				return d.Err("tcp_keepalive must be positive.")
+			}
+			h.TCPKeepAlive = caddy.Duration(period)
+		case "dns_cache_ttl":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.ArgErr()
+			}
+			if ttl <= 0 {
+				return d.Err("dns_cache_ttl must be positive.")
+			}
+			h.DNSCacheTTL = caddy.Duration(ttl)
+		case "max_concurrent_lookups":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return d.Errf("max_concurrent_lookups expects a positive number, got: %s", args[0])
+			}
+			h.MaxConcurrentLookups = n
+		case "upstream_preface":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			// allow escape sequences such as \r\n and \x00
+			preface, err := strconv.Unquote(`"` + args[0] + `"`)
+			if err != nil || preface == "" {
+				return d.Errf("bad upstream_preface: %s", args[0])
+			}
+			h.UpstreamPreface = preface
+		case "egress_mark":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			mark, err := strconv.ParseUint(args[0], 0, 32)
+			if err != nil || mark == 0 {
+				return d.Errf("egress_mark expects a non-zero 32-bit number, got: %s", args[0])
+			}
+			h.EgressMark = int(mark)
+		case "egress_address":
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			h.EgressAddresses = append(h.EgressAddresses, EgressAddress{LocalAddress: args[0], Targets: args[1:]})
+		case "authz_service":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if h.AuthzService != nil {
+				return d.Err("authz_service subdirective specified twice")
+			}
+			h.AuthzService = &AuthzService{URL: args[0]}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				authzDirective := d.Val()
+				args := d.RemainingArgs()
+				switch authzDirective {
+				case "timeout", "cache_ttl":
+					if len(args) != 1 {
+						return d.ArgErr()
+					}
+					duration, err := caddy.ParseDuration(args[0])
+					if err != nil {
+						return d.ArgErr()
+					}
+					if duration <= 0 {
+						return d.Errf("%s must be positive.", authzDirective)
+					}
+					if authzDirective == "timeout" {
+						h.AuthzService.Timeout = caddy.Duration(duration)
+					} else {
+						h.AuthzService.CacheTTL = caddy.Duration(duration)
+					}
+				case "fail_open":
+					if len(args) != 0 {
+						return d.ArgErr()
+					}
+					h.AuthzService.FailOpen = true
+				default:
+					return d.Err("expected authz_service directive: timeout/cache_ttl/fail_open. " +
+						"got: " + authzDirective)
+				}
+			}
 		case "upstream":
 			if len(args) != 1 {
 				return d.ArgErr()
@@ -133,6 +412,43 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Err("upstream directive specified more than once")
 			}
 			h.Upstream = args[0]
+		case "require_header":
+			if len(args) != 1 && len(args) != 2 {
+				return d.ArgErr()
+			}
+			rh := RequiredHeader{Name: args[0]}
+			if len(args) == 2 {
+				rh.Value = args[1]
+			}
+			h.RequiredHeaders = append(h.RequiredHeaders, rh)
+		case "connect_host_pattern":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if h.ConnectHostPattern != "" {
+				return d.Err("connect_host_pattern subdirective specified twice")
+			}
+			h.ConnectHostPattern = args[0]
+		case "aliases":
+			if len(args) > 1 || len(args) == 1 && args[0] != "strict" {
+				return d.ArgErr()
+			}
+			if h.Aliases != nil {
+				return d.Err("aliases subdirective specified twice")
+			}
+			h.StrictAliases = len(args) == 1
+			h.Aliases = make(map[string]string)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				alias := d.Val()
+				args := d.RemainingArgs()
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				if _, ok := h.Aliases[alias]; ok {
+					return d.Errf("alias %s specified twice", alias)
+				}
+				h.Aliases[alias] = args[0]
+			}
 		case "acl":
 			for nesting := d.Nesting(); d.NextBlock(nesting); {
 				aclDirective := d.Val()
@@ -0,0 +1,117 @@
+package forwardproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// parseIPNet parses a CIDR or a single IP address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseIPNets expands placeholders in entries, and parses them with parseIPNet.
+func parseIPNets(entries []string) ([]*net.IPNet, error) {
+	expanded, err := expandList(entries)
+	if err != nil {
+		return nil, err
+	}
+	var ipNets []*net.IPNet
+	for _, subj := range expanded {
+		ipNet, err := parseIPNet(subj)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", subj, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+func (h Handler) isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range h.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed reports whether the client that sent r may use the proxy.
+func (h Handler) clientAllowed(r *http.Request) bool {
+	if len(h.allowClients) == 0 {
+		return true
+	}
+	ip := h.clientIP(r)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range h.allowClients {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns IP address of the client that sent r. If the request came from a trusted proxy,
+// X-Forwarded-For is walked from the right, and the first address that is not a trusted proxy is
+// returned. Entries to the left of it could have been made up by the client and are ignored.
+// Returns nil if RemoteAddr can't be parsed.
+func (h Handler) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !h.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, xff := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if host, _, err := net.SplitHostPort(hop); err == nil {
+			hop = host
+		}
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			// trusted proxy appended garbage; don't look any further
+			return ip
+		}
+		ip = hopIP
+		if !h.isTrustedProxy(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// clientLogFields describes the client that sent r for access logs.
+func (h Handler) clientLogFields(r *http.Request) []zap.Field {
+	ip := h.clientIP(r)
+	fields := []zap.Field{zap.Stringer("client_ip", ip)}
+	if h.ptrCache != nil && ip != nil {
+		if name, ok := h.ptrCache.lookup(ip); ok {
+			fields = append(fields, zap.String("client_hostname", name))
+		}
+	}
+	return fields
+}
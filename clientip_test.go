@@ -0,0 +1,114 @@
+package forwardproxy
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	h := Handler{}
+	for _, subj := range []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"} {
+		ipNet, err := parseIPNet(subj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.trustedProxies = append(h.trustedProxies, ipNet)
+	}
+
+	for _, test := range []struct {
+		remoteAddr string
+		xff        []string
+		clientIP   string
+	}{
+		// direct connections
+		{remoteAddr: "203.0.113.7:5555", clientIP: "203.0.113.7"},
+		{remoteAddr: "[2001:db9::7]:5555", clientIP: "2001:db9::7"},
+		// spoofed X-Forwarded-For from untrusted client is ignored
+		{remoteAddr: "203.0.113.7:5555", xff: []string{"198.51.100.1"}, clientIP: "203.0.113.7"},
+		// single trusted hop
+		{remoteAddr: "10.1.2.3:5555", xff: []string{"203.0.113.7"}, clientIP: "203.0.113.7"},
+		// client made up everything left of the first untrusted hop
+		{remoteAddr: "10.1.2.3:5555", xff: []string{"198.51.100.1, 203.0.113.7"}, clientIP: "203.0.113.7"},
+		// several trusted hops, possibly spread over several headers
+		{remoteAddr: "[2001:db8::1]:5555", xff: []string{"203.0.113.7, 192.0.2.1", "10.9.9.9"}, clientIP: "203.0.113.7"},
+		{remoteAddr: "10.1.2.3:5555", xff: []string{"[2001:db9::7]:1234"}, clientIP: "2001:db9::7"},
+		// all hops are trusted
+		{remoteAddr: "10.1.2.3:5555", xff: []string{"10.3.3.3, 10.2.2.2"}, clientIP: "10.3.3.3"},
+		// trusted proxy without X-Forwarded-For
+		{remoteAddr: "10.1.2.3:5555", clientIP: "10.1.2.3"},
+		// garbage stops the walk at the last known address
+		{remoteAddr: "10.1.2.3:5555", xff: []string{"203.0.113.7, garbage, 10.2.2.2"}, clientIP: "10.2.2.2"},
+	} {
+		r := &http.Request{RemoteAddr: test.remoteAddr, Header: make(http.Header)}
+		for _, xff := range test.xff {
+			r.Header.Add("X-Forwarded-For", xff)
+		}
+		if ip := h.clientIP(r); !ip.Equal(net.ParseIP(test.clientIP)) {
+			t.Fatalf("RemoteAddr=%s X-Forwarded-For=%v: expected client IP %s, got %s",
+				test.remoteAddr, test.xff, test.clientIP, ip)
+		}
+	}
+}
+
+func TestAllowClients(t *testing.T) {
+	h := Handler{}
+	if !h.clientAllowed(&http.Request{RemoteAddr: "203.0.113.7:5555"}) {
+		t.Fatal("expected all clients to be allowed by default")
+	}
+	trusted, err := parseIPNet("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.trustedProxies = []*net.IPNet{trusted}
+	for _, subj := range []string{"203.0.113.0/24", "2001:db8::7"} {
+		ipNet, err := parseIPNet(subj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.allowClients = append(h.allowClients, ipNet)
+	}
+
+	for _, test := range []struct {
+		remoteAddr string
+		xff        string
+		allowed    bool
+	}{
+		{remoteAddr: "203.0.113.7:5555", allowed: true},
+		{remoteAddr: "[2001:db8::7]:5555", allowed: true},
+		{remoteAddr: "198.51.100.1:5555", allowed: false},
+		{remoteAddr: "[2001:db8::8]:5555", allowed: false},
+		// client behind a trusted proxy
+		{remoteAddr: "10.1.2.3:5555", xff: "203.0.113.7", allowed: true},
+		{remoteAddr: "10.1.2.3:5555", xff: "198.51.100.1", allowed: false},
+		// trusted proxy itself is not an allowed client
+		{remoteAddr: "10.1.2.3:5555", allowed: false},
+		// allowed address spoofed by untrusted client
+		{remoteAddr: "198.51.100.1:5555", xff: "203.0.113.7", allowed: false},
+		{remoteAddr: "garbage", allowed: false},
+	} {
+		r := &http.Request{RemoteAddr: test.remoteAddr, Header: make(http.Header)}
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if allowed := h.clientAllowed(r); allowed != test.allowed {
+			t.Fatalf("RemoteAddr=%s X-Forwarded-For=%s: expected allowed=%v, got %v",
+				test.remoteAddr, test.xff, test.allowed, allowed)
+		}
+	}
+}
+
+func TestAllowClientsPlaceholder(t *testing.T) {
+	os.Setenv("FORWARDPROXY_TEST_CLIENTS", "203.0.113.0/24, 2001:db8::7")
+	defer os.Unsetenv("FORWARDPROXY_TEST_CLIENTS")
+	ipNets, err := parseIPNets([]string{"{env.FORWARDPROXY_TEST_CLIENTS}"})
+	if err != nil || len(ipNets) != 2 {
+		t.Fatalf("expected placeholder to expand to 2 networks, got: %v, %v", ipNets, err)
+	}
+
+	// with no entries left, all clients would be allowed
+	if ipNets, err = parseIPNets([]string{"{env.FORWARDPROXY_TEST_UNSET}"}); err == nil {
+		t.Fatal("expected unset variable to be an error, got:", ipNets)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"os"
 	"strconv"
@@ -78,6 +79,9 @@ var (
 	caddyForwardProxyWhiteListing        caddyTestServer
 	caddyForwardProxyBlackListing        caddyTestServer
 	caddyForwardProxyNoBlacklistOverride caddyTestServer // to test default blacklist
+	caddyForwardProxyConnectHostPattern  caddyTestServer // only CONNECTs to caddyTestTarget match the pattern
+	caddyForwardProxyDangerousPorts      caddyTestServer // blocks default dangerous ports
+	caddyForwardProxyAliases             caddyTestServer // only CONNECTs to aliases of caddyTestTarget are allowed
 
 	// authenticated server upstreams to authenticated https proxy with different credentials
 	caddyAuthedUpstreamEnter caddyTestServer
@@ -288,6 +292,37 @@ func TestMain(m *testing.M) {
 		proxyHandler: &Handler{},
 	}
 
+	caddyForwardProxyConnectHostPattern = caddyTestServer{
+		addr: "127.0.66.76:6680",
+		root: "./test/forwardproxy",
+		tls:  true,
+		proxyHandler: &Handler{
+			ACL:                []ACLRule{{Subjects: []string{"all"}, Allow: true}},
+			ConnectHostPattern: `^127\.0\.64\.51:[0-9]+$`,
+		},
+	}
+
+	caddyForwardProxyDangerousPorts = caddyTestServer{
+		addr: "127.0.66.76:6681",
+		root: "./test/forwardproxy",
+		tls:  true,
+		proxyHandler: &Handler{
+			ACL:                 []ACLRule{{Subjects: []string{"all"}, Allow: true}},
+			BlockDangerousPorts: true,
+		},
+	}
+
+	caddyForwardProxyAliases = caddyTestServer{
+		addr: "127.0.66.76:6682",
+		root: "./test/forwardproxy",
+		tls:  true,
+		proxyHandler: &Handler{
+			ACL:           []ACLRule{{Subjects: []string{"all"}, Allow: true}},
+			Aliases:       map[string]string{"testtarget": caddyTestTarget.addr},
+			StrictAliases: true,
+		},
+	}
+
 	// done configuring all the servers; now build the HTTP app
 	httpApp := caddyhttp.App{
 		HTTPPort: 1080, // use a high port to avoid permission issues
@@ -303,6 +338,9 @@ func TestMain(m *testing.M) {
 			"caddyForwardProxyWhiteListing":        caddyForwardProxyWhiteListing.server(),
 			"caddyForwardProxyBlackListing":        caddyForwardProxyBlackListing.server(),
 			"caddyForwardProxyNoBlacklistOverride": caddyForwardProxyNoBlacklistOverride.server(),
+			"caddyForwardProxyConnectHostPattern":  caddyForwardProxyConnectHostPattern.server(),
+			"caddyForwardProxyDangerousPorts":      caddyForwardProxyDangerousPorts.server(),
+			"caddyForwardProxyAliases":             caddyForwardProxyAliases.server(),
 
 			// HTTP->HTTPS redirect simulation servers for those which have a redir port configured
 			"caddyForwardProxyProbeResist_redir": caddyForwardProxyProbeResist.redirServer(),
@@ -487,4 +525,11 @@ var testTransport = &http.Transport{
 	},
 }
 
+// newTestRequest creates a request that can be passed directly to Handler.ServeHTTP.
+func newTestRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	return r.WithContext(ctx)
+}
+
 const defaultPACPath = "/proxy.pac"
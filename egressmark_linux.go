@@ -0,0 +1,17 @@
+package forwardproxy
+
+import "syscall"
+
+// markControl returns a net.Dialer Control function, that sets fwmark of dialed sockets to mark.
+func markControl(mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
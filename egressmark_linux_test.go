@@ -0,0 +1,47 @@
+package forwardproxy
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+// fdConn is a syscall.RawConn of a bare socket.
+type fdConn struct {
+	fd int
+}
+
+func (c fdConn) Control(f func(fd uintptr)) error {
+	f(uintptr(c.fd))
+	return nil
+}
+
+func (c fdConn) Read(f func(fd uintptr) bool) error  { return errors.New("not implemented") }
+func (c fdConn) Write(f func(fd uintptr) bool) error { return errors.New("not implemented") }
+
+func TestMarkControl(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	control, err := markControl(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = control("tcp4", "192.0.2.1:443", fdConn{fd: fd})
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_MARK requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	mark, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != 42 {
+		t.Fatal("expected socket mark 42, got:", mark)
+	}
+}
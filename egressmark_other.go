@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package forwardproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func markControl(mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("egress_mark is only supported on Linux")
+}
@@ -32,9 +32,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -47,6 +50,7 @@ import (
 
 func init() {
 	caddy.RegisterModule(Handler{})
+	caddy.RegisterModule(AdminHealth{})
 
 	// Used for generating padding lengths. Not needed to be cryptographically secure.
 	// Does not care about double seeding.
@@ -57,11 +61,15 @@ func init() {
 //
 // EXPERIMENTAL: This handler is still experimental and subject to breaking changes.
 type Handler struct {
-	logger *zap.Logger
+	logger       *zap.Logger
+	accessLogger *zap.Logger
 
 	// Filename of the PAC file to serve.
 	PACPath string `json:"pac_path,omitempty"`
 
+	// Identifies the handler in health summaries served by the admin API.
+	Name string `json:"name,omitempty"`
+
 	// If true, the Forwarded header will not be augmented with your IP address.
 	HideIP bool `json:"hide_ip,omitempty"`
 
@@ -72,12 +80,84 @@ type Handler struct {
 	// you will give it the host (and port) of the proxy to use.
 	Hosts caddyhttp.MatchHost `json:"hosts,omitempty"`
 
+	// If set, the proxy is only active on TLS connections that negotiated
+	// this ALPN protocol; all other requests are passed to the next handler.
+	OnlyALPN string `json:"only_alpn,omitempty"`
+
+	// If set, proxy requests over TLS versions older than this one ("1.2" or "1.3"),
+	// or over plaintext HTTP, are rejected.
+	MinTLSVersion string `json:"min_tls_version,omitempty"`
+	minTLSVersion uint16
+
 	// Optional probe resistance. (See documentation.)
 	ProbeResistance *ProbeResistance `json:"probe_resistance,omitempty"`
 
+	// If set, replaces the Server header of responses to CONNECT requests.
+	// Empty string removes the header.
+	ServerHeader *string `json:"server_header,omitempty"`
+
+	// If positive, responses to CONNECT requests are delayed by a random duration
+	// below this bound, making handshake timing harder to fingerprint.
+	RandomDelay caddy.Duration `json:"random_delay,omitempty"`
+
+	// If set, these bytes are sent to every CONNECT target right after connecting,
+	// before any data from the client.
+	UpstreamPreface string `json:"upstream_preface,omitempty"`
+
+	// If non-zero, sets fwmark (SO_MARK) of outgoing connections, for policy
+	// routing. Linux only.
+	EgressMark int `json:"egress_mark,omitempty"`
+
+	// If positive, limits how many CONNECT requests may be between arrival and
+	// established connection to the target at once. Excess requests get 503.
+	MaxPendingHandshakes int `json:"max_pending_handshakes,omitempty"`
+	pendingHandshakes    chan struct{}
+
 	// How long to wait before timing out initial TCP connections.
 	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
 
+	// If positive, a single read from a tunneled connection fails when no data
+	// arrives within this duration, which tears the tunnel down.
+	ReadTimeout caddy.Duration `json:"read_timeout,omitempty"`
+
+	// If positive, a single write to a tunneled connection fails when it does
+	// not complete within this duration, which tears the tunnel down.
+	WriteTimeout caddy.Duration `json:"write_timeout,omitempty"`
+
+	// If positive, results of DNS lookups of target hosts are cached for this long.
+	// Failed lookups are cached for at most 5 seconds.
+	DNSCacheTTL caddy.Duration `json:"dns_cache_ttl,omitempty"`
+
+	// If positive, at most this many DNS lookups of target hosts run at once.
+	// Other lookups wait for a free slot, which counts towards DialTimeout.
+	MaxConcurrentLookups int `json:"max_concurrent_lookups,omitempty"`
+
+	// IP addresses and networks of reverse proxies in front of this server, whose
+	// X-Forwarded-For headers are trusted to determine client IP addresses.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// If set, only clients with IP addresses in these networks may use the proxy.
+	// Client IP addresses are determined with regard to TrustedProxies.
+	AllowClients []string `json:"allow_clients,omitempty"`
+	allowClients []*net.IPNet
+
+	// If true, establishment and closure of CONNECT tunnels are logged, with their
+	// target and client.
+	LogTunnels bool `json:"log_tunnels,omitempty"`
+
+	// If true, access logs include the client's hostname, found by reverse DNS lookup
+	// of its IP address. Lookups are done in background, so the hostname may be missing
+	// from logs of the first tunnels of a client.
+	LogClientHostname bool `json:"log_client_hostname,omitempty"`
+	ptrCache          *ptrCache
+
+	// Local addresses to connect to targets from, e.g. on multi-homed hosts.
+	// The first rule that matches a target and its address family is used.
+	EgressAddresses []EgressAddress `json:"egress_addresses,omitempty"`
+
+	// Optional external service that authorizes proxy requests.
+	AuthzService *AuthzService `json:"authz_service,omitempty"`
+
 	// Optionally configure an upstream proxy to use.
 	Upstream string `json:"upstream,omitempty"`
 
@@ -87,14 +167,93 @@ type Handler struct {
 	// Ports to be allowed to connect to (if non-empty).
 	AllowedPorts []int `json:"allowed_ports,omitempty"`
 
+	// If true, ports commonly abused for relaying and lateral movement
+	// are forbidden, unless explicitly listed in AllowedPorts.
+	BlockDangerousPorts bool `json:"block_dangerous_ports,omitempty"`
+
+	// Ports forbidden by BlockDangerousPorts. Defaults to 0, 22, 25, 135, 139, 445 and 3389.
+	DangerousPorts []int `json:"dangerous_ports,omitempty"`
+
+	// Headers that proxy requests must carry. Requests missing any of them are rejected.
+	// Required headers are not forwarded to targets.
+	RequiredHeaders []RequiredHeader `json:"required_headers,omitempty"`
+
+	// If true, credentials embedded in CONNECT targets (user:pass@host:port) are
+	// removed; otherwise such requests are rejected.
+	StripUserinfo bool `json:"strip_userinfo,omitempty"`
+
+	// If positive, each client may open CONNECT tunnels to at most this many distinct
+	// targets within TargetsWindow. Further targets are rejected with 429, e.g. to
+	// stop port and host scanning.
+	MaxTargetsPerClient int `json:"max_targets_per_client,omitempty"`
+
+	// Sliding window for MaxTargetsPerClient. Default: 1m.
+	TargetsWindow caddy.Duration `json:"targets_window,omitempty"`
+	targetLimiter *targetLimiter
+
+	// If positive, at most this many CONNECT tunnels may be open at once, across
+	// all clients and users. Further tunnels are rejected with 429.
+	MaxTunnels  int `json:"max_tunnels,omitempty"`
+	tunnelSlots chan struct{}
+
+	// If true, the hostname of CONNECT targets and proxied HTTP requests must equal
+	// the TLS server name (SNI) the client connected with, so that only that name
+	// may be reached through the proxy.
+	RequireSNIMatch bool `json:"require_sni_match,omitempty"`
+
+	// If true, connections to IP addresses of the machine's own network interfaces
+	// are denied, regardless of the ACL. Addresses are enumerated at provision.
+	DenySelf bool `json:"deny_self,omitempty"`
+
+	// If set, the host:port target of CONNECT requests must match this regular expression.
+	ConnectHostPattern string `json:"connect_host_pattern,omitempty"`
+
+	// Maps names, which clients may use as CONNECT targets, to the real host:port
+	// to connect to. Keys are matched against the full target first, then against
+	// its hostname. Resolved targets are still subject to the ACL.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// If true, CONNECT targets that don't match any of the Aliases are rejected.
+	StrictAliases bool `json:"strict_aliases,omitempty"`
+
+	// If positive, bodies of GET, HEAD, OPTIONS and TRACE requests, which are buffered in
+	// memory to allow retries, are limited to this many bytes.
+	MaxBufferedBody int64 `json:"max_buffered_body,omitempty"`
+
+	// If positive, CONNECT tunnels are closed once they have transferred this many
+	// bytes in total, counting both directions.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// If set, enables or disables Nagle's algorithm on hijacked client connections.
+	// Only plaintext connections are affected: with Go 1.15, *tls.Conn doesn't
+	// expose the underlying TCP connection.
+	TCPNoDelay *bool `json:"tcp_nodelay,omitempty"`
+
+	// If positive, enables TCP keep-alives with given period on hijacked client connections.
+	// Like TCPNoDelay, it only affects plaintext connections.
+	TCPKeepAlive caddy.Duration `json:"tcp_keepalive,omitempty"`
+
 	httpTransport *http.Transport
 
 	// overridden dialContext allows us to redirect requests to upstream proxy
 	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
 	upstream    *url.URL // address of upstream proxy
 
+	resolver      hostResolver     // resolves target hosts; net.DefaultResolver if nil
+	lookupLimiter *limitedResolver // enforces MaxConcurrentLookups, if set
+
+	stats *tunnelStats // tunnel activity for Health
+
+	trustedProxies []*net.IPNet
+
+	egressRules []egressRule
+
 	aclRules []aclRule
 
+	connectHostPattern *regexp.Regexp
+
+	plaintextWarned int32 // set to 1 once plaintext proxying has been warned about
+
 	// TODO: temporary/deprecated - we should try to reuse existing authentication modules instead!
 	BasicauthUser   string `json:"auth_user_deprecated,omitempty"`
 	BasicauthPass   string `json:"auth_pass_deprecated,omitempty"`
@@ -113,11 +272,75 @@ func (Handler) CaddyModule() caddy.ModuleInfo {
 // Provision ensures that h is set up properly before use.
 func (h *Handler) Provision(ctx caddy.Context) error {
 	h.logger = ctx.Logger(h)
+	h.accessLogger = zap.NewNop()
+	if h.LogTunnels {
+		h.accessLogger = h.logger.Named("access")
+	}
+	h.stats = newTunnelStats()
 
 	if h.DialTimeout <= 0 {
 		h.DialTimeout = caddy.Duration(30 * time.Second)
 	}
 
+	if h.MaxTargetsPerClient > 0 {
+		if h.TargetsWindow <= 0 {
+			h.TargetsWindow = caddy.Duration(time.Minute)
+		}
+		h.targetLimiter = newTargetLimiter(h.MaxTargetsPerClient, time.Duration(h.TargetsWindow))
+	}
+
+	if h.MaxPendingHandshakes > 0 {
+		h.pendingHandshakes = make(chan struct{}, h.MaxPendingHandshakes)
+	}
+
+	if h.MinTLSVersion != "" {
+		version, err := parseTLSVersion(h.MinTLSVersion)
+		if err != nil {
+			return err
+		}
+		h.minTLSVersion = version
+	}
+
+	var resolver hostResolver = net.DefaultResolver
+	if h.MaxConcurrentLookups > 0 {
+		h.lookupLimiter = newLimitedResolver(resolver, h.MaxConcurrentLookups, time.Duration(h.DialTimeout))
+		resolver = h.lookupLimiter
+		h.resolver = resolver
+	}
+	if h.DNSCacheTTL > 0 {
+		// cache hits don't take up lookup slots
+		h.resolver = newDNSCache(resolver, time.Duration(h.DNSCacheTTL))
+	}
+
+	if h.LogClientHostname {
+		if !h.LogTunnels {
+			return errors.New("log_client_hostname requires log_tunnels")
+		}
+		h.ptrCache = newPTRCache(net.DefaultResolver)
+	}
+
+	trustedProxies, err := parseIPNets(h.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("bad trusted proxy %v", err)
+	}
+	h.trustedProxies = trustedProxies
+
+	allowClients, err := parseIPNets(h.AllowClients)
+	if err != nil {
+		return fmt.Errorf("bad allowed client %v", err)
+	}
+	h.allowClients = allowClients
+
+	if h.AuthzService != nil {
+		if err := h.AuthzService.provision(); err != nil {
+			return err
+		}
+	}
+
+	if h.BlockDangerousPorts && len(h.DangerousPorts) == 0 {
+		h.DangerousPorts = defaultDangerousPorts
+	}
+
 	h.httpTransport = &http.Transport{
 		Proxy:               http.ProxyFromEnvironment,
 		MaxIdleConns:        50,
@@ -134,8 +357,19 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	}
 
 	// access control lists
+	if h.DenySelf {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return fmt.Errorf("listing local addresses for deny_self: %v", err)
+		}
+		h.aclRules = append(h.aclRules, selfDenyRules(addrs)...)
+	}
 	for _, rule := range h.ACL {
-		for _, subj := range rule.Subjects {
+		subjects, err := expandList(rule.Subjects)
+		if err != nil {
+			return fmt.Errorf("bad acl subject %v", err)
+		}
+		for _, subj := range subjects {
 			ar, err := newACLRule(subj, rule.Allow)
 			if err != nil {
 				return err
@@ -159,6 +393,24 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	}
 	h.aclRules = append(h.aclRules, &aclAllRule{allow: true})
 
+	for alias, target := range h.Aliases {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("bad target %s for alias %s: %v", target, alias, err)
+		}
+	}
+
+	if h.ConnectHostPattern != "" {
+		re, err := regexp.Compile(h.ConnectHostPattern)
+		if err != nil {
+			return fmt.Errorf("bad connect_host_pattern: %v", err)
+		}
+		h.connectHostPattern = re
+	}
+
+	if h.MaxTunnels > 0 {
+		h.tunnelSlots = make(chan struct{}, h.MaxTunnels)
+	}
+
 	if h.ProbeResistance != nil {
 		if !h.authRequired {
 			return fmt.Errorf("probe resistance requires authentication")
@@ -173,7 +425,31 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		KeepAlive: 30 * time.Second,
 		DualStack: true,
 	}
+	if h.EgressMark != 0 {
+		control, err := markControl(h.EgressMark)
+		if err != nil {
+			return err
+		}
+		dialer.Control = control
+	}
 	h.dialContext = dialer.DialContext
+	for _, ea := range h.EgressAddresses {
+		localIP := net.ParseIP(ea.LocalAddress)
+		if localIP == nil {
+			return fmt.Errorf("bad egress local address: %s", ea.LocalAddress)
+		}
+		egressDialer := *dialer
+		egressDialer.LocalAddr = &net.TCPAddr{IP: localIP}
+		er := egressRule{localIP: localIP, dialContext: egressDialer.DialContext}
+		for _, subj := range ea.Targets {
+			ar, err := newACLRule(subj, true)
+			if err != nil {
+				return err
+			}
+			er.targets = append(er.targets, ar)
+		}
+		h.egressRules = append(h.egressRules, er)
+	}
 	h.httpTransport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
 		return h.dialContextCheckACL(ctx, network, address)
 	}
@@ -231,10 +507,21 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	registerHandler(h)
+	return nil
+}
+
+// Cleanup stops serving health of h.
+func (h *Handler) Cleanup() error {
+	unregisterHandler(h)
 	return nil
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if h.OnlyALPN != "" && (r.TLS == nil || r.TLS.NegotiatedProtocol != h.OnlyALPN) {
+		return next.ServeHTTP(w, r)
+	}
+
 	// start by splitting the request host and port
 	reqHost, _, err := net.SplitHostPort(r.Host)
 	if err != nil {
@@ -256,6 +543,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		}
 		return next.ServeHTTP(w, r)
 	}
+	if !h.clientAllowed(r) {
+		if h.ProbeResistance != nil {
+			return next.ServeHTTP(w, r)
+		}
+		return caddyhttp.Error(http.StatusForbidden,
+			fmt.Errorf("client %s is not allowed", h.clientIP(r)))
+	}
 	if authErr != nil {
 		if h.ProbeResistance != nil {
 			// probe resistance is requested and requested URI does not match secret domain;
@@ -266,11 +560,31 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		return caddyhttp.Error(http.StatusProxyAuthRequired, authErr)
 	}
 
+	if err := h.checkRequiredHeaders(r); err != nil {
+		if h.ProbeResistance != nil {
+			// same as failed authentication; don't reveal the proxy
+			return next.ServeHTTP(w, r)
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	if err := h.checkTLSVersion(r); err != nil {
+		if h.ProbeResistance != nil {
+			return next.ServeHTTP(w, r)
+		}
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+
 	if r.ProtoMajor != 1 && r.ProtoMajor != 2 && r.ProtoMajor != 3 {
 		return caddyhttp.Error(http.StatusHTTPVersionNotSupported,
 			fmt.Errorf("unsupported HTTP major version: %d", r.ProtoMajor))
 	}
 
+	if r.TLS == nil && atomic.CompareAndSwapInt32(&h.plaintextWarned, 0, 1) {
+		h.logger.Warn("proxying over plaintext HTTP: credentials and target hosts are not encrypted",
+			zap.Stringer("client_ip", h.clientIP(r)))
+	}
+
 	ctx := context.Background()
 	if !h.HideIP {
 		ctxHeader := make(http.Header)
@@ -286,8 +600,39 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	if r.Method == http.MethodConnect {
 		if r.ProtoMajor == 2 || r.ProtoMajor == 3 {
 			if len(r.URL.Scheme) > 0 || len(r.URL.Path) > 0 {
-				return caddyhttp.Error(http.StatusBadRequest,
-					fmt.Errorf("CONNECT request has :scheme and/or :path pseudo-header fields"))
+				return h.rejectTunnel("malformed_request", caddyhttp.Error(http.StatusBadRequest,
+					fmt.Errorf("CONNECT request has :scheme and/or :path pseudo-header fields")))
+			}
+		}
+
+		handshakeDone, ok := h.startHandshake()
+		if !ok {
+			return h.rejectTunnel("pending_handshakes", caddyhttp.Error(http.StatusServiceUnavailable,
+				fmt.Errorf("too many pending CONNECT handshakes")))
+		}
+		defer handshakeDone()
+
+		hostPort, err := h.connectTarget(r)
+		if err != nil {
+			return err
+		}
+		if err := h.checkAuthzService(r, hostPort); err != nil {
+			return h.rejectTunnel("authz_service", err)
+		}
+		if h.tunnelSlots != nil {
+			select {
+			case h.tunnelSlots <- struct{}{}:
+				defer func() { <-h.tunnelSlots }()
+			default:
+				return h.rejectTunnel("tunnels", caddyhttp.Error(http.StatusTooManyRequests,
+					fmt.Errorf("too many open tunnels")))
+			}
+		}
+		if h.targetLimiter != nil {
+			// the target only counts once the tunnel is established
+			if client := h.clientIP(r).String(); !h.targetLimiter.allowed(client, hostPort) {
+				return h.rejectTunnel("targets_per_client", caddyhttp.Error(http.StatusTooManyRequests,
+					fmt.Errorf("client %s connected to too many distinct targets", client)))
 			}
 		}
 
@@ -310,15 +655,23 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 			padding[i] = '~'
 		}
 		w.Header().Set("Padding", string(padding))
+		h.setServerHeader(w.Header())
+		if d := h.randomDelay(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return nil
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 		wFlusher.Flush()
 
-		hostPort := r.URL.Host
-		if hostPort == "" {
-			hostPort = r.Host
-		}
 		targetConn, err := h.dialContextCheckACL(ctx, "tcp", hostPort)
+		handshakeDone()
 		if err != nil {
+			if herr, ok := err.(caddyhttp.HandlerError); ok && herr.StatusCode == http.StatusForbidden {
+				return h.rejectTunnel("acl", err)
+			}
 			return err
 		}
 		if targetConn == nil {
@@ -328,15 +681,57 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 				fmt.Errorf("hostname %s is not allowed", r.URL.Hostname()))
 		}
 		defer targetConn.Close()
+		if h.targetLimiter != nil {
+			h.targetLimiter.record(h.clientIP(r).String(), hostPort)
+		}
+		if h.upstream == nil {
+			// upstream connections may be multiplexed over a single connection, whose
+			// deadlines must not be touched
+			targetConn = h.withTimeouts(targetConn)
+		}
+		if h.UpstreamPreface != "" {
+			if _, err := io.WriteString(targetConn, h.UpstreamPreface); err != nil {
+				return caddyhttp.Error(http.StatusBadGateway,
+					fmt.Errorf("failed to send preface to %s: %v", hostPort, err))
+			}
+		}
+		if h.MaxBytes > 0 {
+			targetConn = h.withByteLimit(targetConn, hostPort)
+		}
+
+		start := time.Now()
+		if h.stats != nil {
+			info := TunnelInfo{Target: hostPort, ClientIP: h.clientIP(r).String(), Started: start}
+			if h.authRequired {
+				info.User = proxyUser(r)
+			}
+			defer h.stats.close(h.stats.open(info))
+		}
+		h.accessLogger.Info("tunnel established",
+			append([]zap.Field{zap.String("target", hostPort)}, h.clientLogFields(r)...)...)
+		var tunnelErr error
+		defer func() {
+			fields := []zap.Field{
+				zap.String("target", hostPort),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("close_reason", closeReason(tunnelErr)),
+			}
+			if tunnelErr != nil {
+				fields = append(fields, zap.Error(tunnelErr))
+			}
+			h.accessLogger.Info("tunnel closed", append(fields, h.clientLogFields(r)...)...)
+		}()
 
 		switch r.ProtoMajor {
 		case 1: // http1: hijack the whole flow
-			return serveHijack(w, targetConn)
+			tunnelErr = h.serveHijack(w, targetConn)
+			return tunnelErr
 		case 2: // http2: keep reading from "request" and writing into same response
 			fallthrough
 		case 3:
 			defer r.Body.Close()
-			return dualStream(targetConn, r.Body, w, r.Header.Get("Padding") != "")
+			tunnelErr = dualStream(targetConn, r.Body, w, r.Header.Get("Padding") != "")
+			return tunnelErr
 		}
 
 		panic("There was a check for http version, yet it's incorrect")
@@ -351,12 +746,32 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	if r.URL.Host == "" {
 		r.URL.Host = r.Host
 	}
+	if h.RequireSNIMatch && !matchesSNI(r, r.URL.Hostname()) {
+		return caddyhttp.Error(http.StatusForbidden,
+			fmt.Errorf("proxy request to %s does not match TLS server name", r.URL.Host))
+	}
+	if h.AuthzService != nil {
+		hostPort := r.URL.Host
+		if r.URL.Port() == "" {
+			port := "80"
+			if r.URL.Scheme == "https" {
+				port = "443"
+			}
+			hostPort = net.JoinHostPort(r.URL.Hostname(), port)
+		}
+		if err := h.checkAuthzService(r, hostPort); err != nil {
+			return err
+		}
+	}
 	r.Proto = "HTTP/1.1"
 	r.ProtoMajor = 1
 	r.ProtoMinor = 1
 	r.RequestURI = ""
 
 	removeHopByHop(r.Header)
+	for _, rh := range h.RequiredHeaders {
+		r.Header.Del(rh.Name)
+	}
 
 	if !h.HideIP {
 		r.Header.Add("Forwarded", "for=\""+r.RemoteAddr+"\"")
@@ -375,11 +790,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 			// make sure request is idempotent and could be retried by saving the Body
 			// None of those methods are supposed to have body,
 			// but we still need to copy the r.Body, even if it's empty
-			rBodyBuf, err := ioutil.ReadAll(r.Body)
+			var body io.Reader = r.Body
+			if h.MaxBufferedBody > 0 {
+				body = io.LimitReader(r.Body, h.MaxBufferedBody+1)
+			}
+			rBodyBuf, err := ioutil.ReadAll(body)
 			if err != nil {
 				return caddyhttp.Error(http.StatusBadRequest,
 					fmt.Errorf("failed to read request body: %v", err))
 			}
+			if h.MaxBufferedBody > 0 && int64(len(rBodyBuf)) > h.MaxBufferedBody {
+				return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+					fmt.Errorf("request body exceeds %d bytes", h.MaxBufferedBody))
+			}
 			r.GetBody = func() (io.ReadCloser, error) {
 				return ioutil.NopCloser(bytes.NewReader(rBodyBuf)), nil
 			}
@@ -430,23 +853,217 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	return forwardResponse(w, response)
 }
 
+var (
+	errNoProxyAuthorization = errors.New("Proxy-Authorization is required! Expected format: <type> <credentials>")
+	errAuthTypeNotSupported = errors.New("Auth type is not supported")
+	errInvalidCredentials   = errors.New("Invalid credentials")
+)
+
+// checkCredentials is called for every request, including ones not meant for the proxy,
+// so it avoids allocating.
 func (h Handler) checkCredentials(r *http.Request) error {
-	pa := strings.Split(r.Header.Get("Proxy-Authorization"), " ")
-	if len(pa) != 2 {
-		return errors.New("Proxy-Authorization is required! Expected format: <type> <credentials>")
+	pa := r.Header.Get("Proxy-Authorization")
+	sp := strings.IndexByte(pa, ' ')
+	if sp < 0 || strings.IndexByte(pa[sp+1:], ' ') >= 0 {
+		return errNoProxyAuthorization
 	}
-	if strings.ToLower(pa[0]) != "basic" {
-		return errors.New("Auth type is not supported")
+	if !isBasicAuthType(pa[:sp]) {
+		return errAuthTypeNotSupported
 	}
+	credentials := []byte(pa[sp+1:])
 	for _, creds := range h.authCredentials {
-		if subtle.ConstantTimeCompare(creds, []byte(pa[1])) == 1 {
+		if subtle.ConstantTimeCompare(creds, credentials) == 1 {
 			// Please do not consider this to be timing-attack-safe code. Simple equality is almost
 			// mindlessly substituted with constant time algo and there ARE known issues with this code,
 			// e.g. size of smallest credentials is guessable. TODO: protect from all the attacks! Hash?
 			return nil
 		}
 	}
-	return errors.New("Invalid credentials")
+	return errInvalidCredentials
+}
+
+// isBasicAuthType reports whether authType is "basic", ignoring ASCII case.
+func isBasicAuthType(authType string) bool {
+	const basic = "basic"
+	if len(authType) != len(basic) {
+		return false
+	}
+	for i := 0; i < len(basic); i++ {
+		if authType[i]|0x20 != basic[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// proxyUser returns the username from already validated Basic credentials of r.
+func proxyUser(r *http.Request) string {
+	pa := r.Header.Get("Proxy-Authorization")
+	if sp := strings.IndexByte(pa, ' '); sp >= 0 {
+		pa = pa[sp+1:]
+	}
+	creds, err := base64.StdEncoding.DecodeString(pa)
+	if err != nil {
+		return ""
+	}
+	user := string(creds)
+	if colon := strings.IndexByte(user, ':'); colon >= 0 {
+		user = user[:colon]
+	}
+	return user
+}
+
+// randomDelay returns a random duration in [0, RandomDelay).
+func (h Handler) randomDelay() time.Duration {
+	if h.RandomDelay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(h.RandomDelay)))
+}
+
+// matchesSNI reports whether host is the server name that the client sent in TLS handshake.
+func matchesSNI(r *http.Request, host string) bool {
+	if r.TLS == nil || r.TLS.ServerName == "" {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(r.TLS.ServerName, "."))
+}
+
+// isValidHost reports whether host is an IP address or a syntactically valid hostname:
+// at most 253 characters, with labels of 1 to 63 letters, digits, hyphens and
+// underscores, not starting or ending with a hyphen. A trailing dot is allowed.
+func isValidHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// connectTarget parses and validates the target of CONNECT request r, and resolves
+// it if it is an alias. Returned error is a HandlerError to reject r with.
+func (h Handler) connectTarget(r *http.Request) (string, error) {
+	hostPort := r.URL.Host
+	if hostPort == "" {
+		hostPort = r.Host
+	}
+	if i := strings.LastIndex(hostPort, "@"); i >= 0 || r.URL.User != nil {
+		// net/http moves userinfo of HTTP/1.1 CONNECT targets to r.URL.User,
+		// but leaves the :authority of HTTP/2 and HTTP/3 requests as is
+		if !h.StripUserinfo {
+			return "", h.rejectTunnel("malformed_request", caddyhttp.Error(http.StatusBadRequest,
+				errors.New("CONNECT target must not contain credentials")))
+		}
+		hostPort = hostPort[i+1:]
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil || !isValidHost(host) {
+		return "", h.rejectTunnel("malformed_request", caddyhttp.Error(http.StatusBadRequest,
+			fmt.Errorf("malformed CONNECT target %q", hostPort)))
+	}
+	if h.RequireSNIMatch && !matchesSNI(r, host) {
+		return "", h.rejectTunnel("sni_mismatch", caddyhttp.Error(http.StatusForbidden,
+			fmt.Errorf("CONNECT target %s does not match TLS server name", hostPort)))
+	}
+	if h.connectHostPattern != nil && !h.connectHostPattern.MatchString(hostPort) {
+		return "", h.rejectTunnel("connect_host_pattern", caddyhttp.Error(http.StatusBadRequest,
+			fmt.Errorf("CONNECT target %s does not match connect_host_pattern", hostPort)))
+	}
+	if len(h.Aliases) > 0 {
+		target, ok := h.resolveAlias(hostPort)
+		if ok {
+			hostPort = target
+		} else if h.StrictAliases {
+			return "", h.rejectTunnel("unknown_alias", caddyhttp.Error(http.StatusNotFound,
+				fmt.Errorf("CONNECT target %s is not a known alias", hostPort)))
+		}
+	}
+	if h.upstream == nil {
+		// checked again on dial, but the client must see the 403 before fast open
+		if _, port, err := net.SplitHostPort(hostPort); err == nil && !h.portIsAllowed(port) {
+			return "", h.rejectTunnel("port", caddyhttp.Error(http.StatusForbidden,
+				fmt.Errorf("port %s is not allowed", port)))
+		}
+	}
+	return hostPort, nil
+}
+
+// resolveAlias looks up the real target of an aliased CONNECT target.
+func (h Handler) resolveAlias(hostPort string) (string, bool) {
+	if target, ok := h.Aliases[hostPort]; ok {
+		return target, true
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", false
+	}
+	target, ok := h.Aliases[host]
+	return target, ok
+}
+
+// checkRequiredHeaders returns an error if r lacks any of the required headers.
+func (h Handler) checkRequiredHeaders(r *http.Request) error {
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+outer:
+	for _, rh := range h.RequiredHeaders {
+		values := r.Header.Values(rh.Name)
+		if len(values) == 0 {
+			return fmt.Errorf("required header %s is missing", rh.Name)
+		}
+		if rh.Value == "" {
+			continue
+		}
+		expected := rh.Value
+		if repl != nil {
+			// placeholders such as {env.PROXY_MARKER} keep secrets out of config
+			expected = repl.ReplaceAll(expected, "")
+		}
+		for _, v := range values {
+			if v == expected {
+				continue outer
+			}
+		}
+		return fmt.Errorf("required header %s has unexpected value", rh.Name)
+	}
+	return nil
+}
+
+// parseTLSVersion converts a TLS version such as "1.2" to its crypto/tls constant.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported min_tls_version: %s (expected 1.2 or 1.3)", version)
+}
+
+func (h Handler) checkTLSVersion(r *http.Request) error {
+	if h.minTLSVersion == 0 {
+		return nil
+	}
+	if r.TLS == nil {
+		return errors.New("proxy requests over plaintext HTTP are not allowed")
+	}
+	if r.TLS.Version < h.minTLSVersion {
+		return fmt.Errorf("TLS version %#04x is below min_tls_version", r.TLS.Version)
+	}
+	return nil
 }
 
 func (h Handler) shouldServePACFile(r *http.Request) bool {
@@ -491,8 +1108,15 @@ func (h Handler) dialContextCheckACL(ctx context.Context, network, hostPort stri
 			fmt.Errorf("port %s is not allowed", port))
 	}
 
-	// in case IP was provided, net.LookupIP will simply return it
-	IPs, err := net.LookupIP(host)
+	if h.DialTimeout > 0 {
+		// waiting for a lookup slot and dialing share a single timeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.DialTimeout))
+		defer cancel()
+	}
+
+	// in case IP was provided, lookupIP will simply return it
+	IPs, err := h.lookupIP(ctx, host)
 	if err != nil {
 		// return nil, &proxyError{S: fmt.Sprintf("Lookup of %s failed: %v", host, err),
 		// Code: http.StatusBadGateway}
@@ -507,7 +1131,11 @@ func (h Handler) dialContextCheckACL(ctx context.Context, network, hostPort stri
 			continue
 		}
 
-		conn, err = h.dialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		dialContext := h.dialContext
+		if er := h.egressRuleFor(host, ip); er != nil {
+			dialContext = er.dialContext
+		}
+		conn, err = dialContext(ctx, network, net.JoinHostPort(ip.String(), port))
 		if err == nil {
 			return conn, nil
 		}
@@ -530,6 +1158,67 @@ func (h Handler) hostIsAllowed(hostname string, ip net.IP) bool {
 	return false
 }
 
+// expandList replaces global placeholders, such as {env.ALLOWED_HOSTS}, in list entries,
+// and splits the results on commas, so that a single variable may hold a whole list.
+// Entries that expand to nothing are an error.
+func expandList(entries []string) ([]string, error) {
+	repl := caddy.NewReplacer()
+	var expanded []string
+	for _, entry := range entries {
+		if !strings.Contains(entry, "{") {
+			expanded = append(expanded, entry)
+			continue
+		}
+		n := len(expanded)
+		for _, e := range strings.Split(repl.ReplaceAll(entry, ""), ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				expanded = append(expanded, e)
+			}
+		}
+		if len(expanded) == n {
+			// dropping the entry could widen the list's meaning, e.g. allow all clients
+			return nil, fmt.Errorf("%s: expands to nothing", entry)
+		}
+	}
+	return expanded, nil
+}
+
+// selfDenyRules returns ACL rules that deny connections to given local addresses,
+// and to unspecified addresses, that also reach the local machine.
+func selfDenyRules(addrs []net.Addr) []aclRule {
+	rules := []aclRule{
+		&aclIPRule{net: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(32, 32)}},
+		&aclIPRule{net: net.IPNet{IP: net.IPv6unspecified, Mask: net.CIDRMask(128, 128)}},
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, bits := ipNet.IP.To4(), 32
+		if ip == nil {
+			ip, bits = ipNet.IP, 128
+		}
+		rules = append(rules, &aclIPRule{net: net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+	}
+	return rules
+}
+
+// egressRuleFor returns the first egress rule that applies to connections to ip of hostname.
+func (h Handler) egressRuleFor(hostname string, ip net.IP) *egressRule {
+	for i, er := range h.egressRules {
+		if (er.localIP.To4() == nil) != (ip.To4() == nil) {
+			continue
+		}
+		for _, target := range er.targets {
+			if target.tryMatch(ip, hostname) == aclDecisionAllow {
+				return &h.egressRules[i]
+			}
+		}
+	}
+	return nil
+}
+
 func (h Handler) portIsAllowed(port string) bool {
 	portInt, err := strconv.Atoi(port)
 	if err != nil {
@@ -539,6 +1228,13 @@ func (h Handler) portIsAllowed(port string) bool {
 		return false
 	}
 	if len(h.AllowedPorts) == 0 {
+		if h.BlockDangerousPorts {
+			for _, p := range h.DangerousPorts {
+				if p == portInt {
+					return false
+				}
+			}
+		}
 		return true
 	}
 	isAllowed := false
@@ -577,7 +1273,7 @@ func serveHiddenPage(w http.ResponseWriter, authErr error) error {
 
 // Hijacks the connection from ResponseWriter, writes the response and proxies data between targetConn
 // and hijacked connection.
-func serveHijack(w http.ResponseWriter, targetConn net.Conn) error {
+func (h Handler) serveHijack(w http.ResponseWriter, targetConn net.Conn) error {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		return caddyhttp.Error(http.StatusInternalServerError,
@@ -589,6 +1285,8 @@ func serveHijack(w http.ResponseWriter, targetConn net.Conn) error {
 			fmt.Errorf("hijack failed: %v", err))
 	}
 	defer clientConn.Close()
+	h.applyTCPOptions(clientConn)
+	clientConn = h.withTimeouts(clientConn)
 	// bufReader may contain unprocessed buffered data from the client.
 	if bufReader != nil {
 		// snippet borrowed from `proxy` plugin
@@ -609,9 +1307,16 @@ func serveHijack(w http.ResponseWriter, targetConn net.Conn) error {
 		Header:     make(http.Header),
 	}
 	res.Header.Set("Server", "Caddy")
+	h.setServerHeader(res.Header)
 
 	err = res.Write(clientConn)
 	if err != nil {
+		if isClientGone(err) {
+			h.logger.Debug("client went away before CONNECT response was sent",
+				zap.String("remote_addr", clientConn.RemoteAddr().String()),
+				zap.Error(err))
+			return nil
+		}
 		return caddyhttp.Error(http.StatusInternalServerError,
 			fmt.Errorf("failed to send response to client: %v", err))
 	}
@@ -619,6 +1324,206 @@ func serveHijack(w http.ResponseWriter, targetConn net.Conn) error {
 	return dualStream(targetConn, clientConn, clientConn, false)
 }
 
+// setServerHeader applies configured ServerHeader, if any, to header.
+func (h Handler) setServerHeader(header http.Header) {
+	if h.ServerHeader == nil {
+		return
+	}
+	if *h.ServerHeader == "" {
+		header.Del("Server")
+	} else {
+		header.Set("Server", *h.ServerHeader)
+	}
+}
+
+// withTimeouts wraps conn to enforce configured read and write timeouts, if any.
+func (h Handler) withTimeouts(conn net.Conn) net.Conn {
+	if h.ReadTimeout <= 0 && h.WriteTimeout <= 0 {
+		return conn
+	}
+	return &timeoutConn{
+		Conn:         conn,
+		readTimeout:  time.Duration(h.ReadTimeout),
+		writeTimeout: time.Duration(h.WriteTimeout),
+	}
+}
+
+// timeoutConn sets a deadline before each Read and Write on the underlying connection.
+type timeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *timeoutConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// withByteLimit wraps conn to close it once MaxBytes have been read from and written to it.
+func (h Handler) withByteLimit(conn net.Conn, hostPort string) net.Conn {
+	return &byteLimitConn{
+		Conn:      conn,
+		remaining: h.MaxBytes,
+		onLimit: func() {
+			h.logger.Debug("closing tunnel that reached byte limit",
+				zap.String("target", hostPort),
+				zap.Int64("max_bytes", h.MaxBytes))
+		},
+	}
+}
+
+var errByteLimitReached = errors.New("tunnel byte limit reached")
+
+// byteLimitConn closes the underlying connection once it has transferred
+// a given number of bytes in both directions combined.
+type byteLimitConn struct {
+	net.Conn
+	remaining int64 // accessed atomically
+	limitHit  int32 // accessed atomically
+	once      sync.Once
+	onLimit   func()
+}
+
+// reserve claims up to n bytes of the remaining budget and returns how many were claimed.
+func (c *byteLimitConn) reserve(n int) int {
+	for {
+		remaining := atomic.LoadInt64(&c.remaining)
+		if remaining <= 0 {
+			return 0
+		}
+		claimed := int64(n)
+		if claimed > remaining {
+			claimed = remaining
+		}
+		if atomic.CompareAndSwapInt64(&c.remaining, remaining, remaining-claimed) {
+			return int(claimed)
+		}
+	}
+}
+
+// release returns unused bytes of a reservation to the budget.
+func (c *byteLimitConn) release(n int) {
+	if n > 0 {
+		atomic.AddInt64(&c.remaining, int64(n))
+	}
+}
+
+func (c *byteLimitConn) limitReached() {
+	c.once.Do(func() {
+		atomic.StoreInt32(&c.limitHit, 1)
+		if c.onLimit != nil {
+			c.onLimit()
+		}
+		// closing unblocks the other direction of the tunnel
+		c.Conn.Close()
+	})
+}
+
+// limitErr replaces err with errByteLimitReached if the connection failed
+// because it was closed at the limit.
+func (c *byteLimitConn) limitErr(err error) error {
+	if err != nil && atomic.LoadInt32(&c.limitHit) == 1 {
+		return errByteLimitReached
+	}
+	return err
+}
+
+func (c *byteLimitConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return c.Conn.Read(b)
+	}
+	allowed := c.reserve(len(b))
+	if allowed == 0 {
+		c.limitReached()
+		return 0, errByteLimitReached
+	}
+	n, err := c.Conn.Read(b[:allowed])
+	c.release(allowed - n)
+	return n, c.limitErr(err)
+}
+
+func (c *byteLimitConn) Write(b []byte) (int, error) {
+	allowed := c.reserve(len(b))
+	n, err := c.Conn.Write(b[:allowed])
+	c.release(allowed - n)
+	if err == nil && n < len(b) {
+		c.limitReached()
+		err = errByteLimitReached
+	}
+	return n, c.limitErr(err)
+}
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *byteLimitConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+type tcpOptionsSetter interface {
+	SetNoDelay(noDelay bool) error
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// netConner is implemented by *tls.Conn since Go 1.18.
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// applyTCPOptions applies configured TCP options to conn, if it is (or wraps) a TCP connection.
+// TLS connections only expose the wrapped connection with Go 1.18+, so with Go 1.15
+// the options only reach plaintext connections.
+func (h Handler) applyTCPOptions(conn net.Conn) {
+	if h.TCPNoDelay == nil && h.TCPKeepAlive <= 0 {
+		return
+	}
+	if nc, ok := conn.(netConner); ok {
+		conn = nc.NetConn()
+	}
+	tc, ok := conn.(tcpOptionsSetter)
+	if !ok {
+		h.logger.Debug("not a TCP connection, TCP options are not applied",
+			zap.String("type", fmt.Sprintf("%T", conn)))
+		return
+	}
+	if h.TCPNoDelay != nil {
+		if err := tc.SetNoDelay(*h.TCPNoDelay); err != nil {
+			h.logger.Debug("failed to set TCP_NODELAY", zap.Error(err))
+		}
+	}
+	if h.TCPKeepAlive > 0 {
+		if err := tc.SetKeepAlive(true); err != nil {
+			h.logger.Debug("failed to enable TCP keep-alive", zap.Error(err))
+		} else if err := tc.SetKeepAlivePeriod(time.Duration(h.TCPKeepAlive)); err != nil {
+			h.logger.Debug("failed to set TCP keep-alive period", zap.Error(err))
+		}
+	}
+}
+
 const (
 	NoPadding        = 0
 	AddPadding       = 1
@@ -627,9 +1532,21 @@ const (
 )
 
 // Copies data target->clientReader and clientWriter->target, and flushes as needed
-// Returns when clientWriter-> target stream is done.
+// Returns when clientWriter-> target stream is done, with the first error of either direction.
 // Caddy should finish writing target -> clientReader.
 func dualStream(target net.Conn, clientReader io.ReadCloser, clientWriter io.Writer, padding bool) error {
+	var mu sync.Mutex
+	var firstErr error
+	// the first error is what ended the tunnel; once one direction fails and tears
+	// the tunnel down, the other one merely sees a closed connection
+	recordErr := func(err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		return firstErr
+	}
 	stream := func(w io.Writer, r io.Reader, paddingType int) error {
 		// copy bytes from r to w
 		buf := bufferPool.Get().([]byte)
@@ -641,13 +1558,72 @@ func dualStream(target net.Conn, clientReader io.ReadCloser, clientWriter io.Wri
 		}
 		return _err
 	}
+	upstream := func(paddingType int) {
+		if err := stream(target, clientReader, paddingType); err != nil {
+			recordErr(err)
+			// client is gone without closing its side properly; the target might never
+			// close its side in response to a half-close, so tear the tunnel down
+			target.Close()
+		}
+	}
 	if padding {
-		go stream(target, clientReader, RemovePadding)
-		return stream(clientWriter, target, AddPadding)
+		go upstream(RemovePadding)
+		return recordErr(stream(clientWriter, target, AddPadding))
 	} else {
-		go stream(target, clientReader, NoPadding)
-		return stream(clientWriter, target, NoPadding)
+		go upstream(NoPadding)
+		return recordErr(stream(clientWriter, target, NoPadding))
+	}
+}
+
+// startHandshake reserves a slot for a pending CONNECT handshake, if they are limited.
+// Returned function frees the slot; it may be called more than once.
+func (h Handler) startHandshake() (done func(), ok bool) {
+	if h.pendingHandshakes != nil {
+		select {
+		case h.pendingHandshakes <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	if h.stats != nil {
+		atomic.AddInt64(&h.stats.pending, 1)
 	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if h.stats != nil {
+				atomic.AddInt64(&h.stats.pending, -1)
+			}
+			if h.pendingHandshakes != nil {
+				<-h.pendingHandshakes
+			}
+		})
+	}, true
+}
+
+// closeReason classifies the error that ended a tunnel, so that network problems
+// can be told apart from clean closes in logs.
+func closeReason(err error) string {
+	if err == nil || errors.Is(err, io.EOF) {
+		return "closed"
+	}
+	if errors.Is(err, errByteLimitReached) {
+		return "byte_limit"
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return "reset"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "error"
+}
+
+// isClientGone reports whether err means that the client has closed the connection.
+func isClientGone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrClosedPipe) || errors.Is(err, context.Canceled)
 }
 
 type closeWriter interface {
@@ -768,6 +1744,9 @@ function FindProxyForURL(url, host) {
 }
 `
 
+// Ports denied by block_dangerous_ports, unless overridden: ssh, smtp, msrpc, netbios, smb and rdp.
+var defaultDangerousPorts = []int{0, 22, 25, 135, 139, 445, 3389}
+
 var bufferPool = sync.Pool{
 	New: func() interface{} {
 		return make([]byte, 0, 64*1024)
@@ -786,6 +1765,29 @@ type dialContexter interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// EgressAddress describes a local address to connect to some targets from.
+type EgressAddress struct {
+	// Local IP address to bind to.
+	LocalAddress string `json:"local_address,omitempty"`
+
+	// Targets in the same format as ACL subjects: IP addresses, networks, hostnames or "all".
+	Targets []string `json:"targets,omitempty"`
+}
+
+type egressRule struct {
+	localIP     net.IP
+	targets     []aclRule
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// RequiredHeader describes a header that proxy requests must carry.
+type RequiredHeader struct {
+	Name string `json:"name,omitempty"`
+
+	// If set, one of the header's values must be equal to Value.
+	Value string `json:"value,omitempty"`
+}
+
 // ProbeResistance configures probe resistance.
 type ProbeResistance struct {
 	Domain string `json:"domain,omitempty"`
@@ -810,6 +1812,8 @@ func readLinesFromFile(filename string) ([]string, error) {
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
+	_ caddy.AdminRouter           = AdminHealth{}
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 	_ caddyfile.Unmarshaler       = (*Handler)(nil)
 )
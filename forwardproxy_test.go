@@ -16,17 +16,30 @@ package forwardproxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/forwardproxy/httpclient"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/net/http2"
 )
 
@@ -411,3 +424,898 @@ func TestUpstreamPassthrough(t *testing.T) {
 		t.Fatalf("Expected: 404 StatusNotFound, got %d. Response: %#v\n", resp.StatusCode, resp)
 	}
 }
+
+func TestOnlyALPN(t *testing.T) {
+	// connect_host_pattern that never matches: an active proxy rejects the CONNECT with 400
+	h := &Handler{OnlyALPN: "h2", connectHostPattern: regexp.MustCompile(`^$`)}
+	for _, test := range []struct {
+		tls    *tls.ConnectionState
+		active bool
+	}{
+		{tls: nil, active: false},
+		{tls: &tls.ConnectionState{NegotiatedProtocol: "http/1.1"}, active: false},
+		{tls: &tls.ConnectionState{NegotiatedProtocol: ""}, active: false},
+		{tls: &tls.ConnectionState{NegotiatedProtocol: "h2"}, active: true},
+	} {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.TLS = test.tls
+		nextCalled := false
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			nextCalled = true
+			return nil
+		})
+		err := h.ServeHTTP(httptest.NewRecorder(), r, next)
+		if test.active {
+			if nextCalled {
+				t.Fatalf("tls=%+v: expected proxy to handle the request, but next handler was called", test.tls)
+			}
+			if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusBadRequest {
+				t.Fatalf("tls=%+v: expected 400 error, got: %v", test.tls, err)
+			}
+		} else if !nextCalled || err != nil {
+			t.Fatalf("tls=%+v: expected request to be passed to next handler, got err: %v", test.tls, err)
+		}
+	}
+}
+
+func TestPlaintextWarning(t *testing.T) {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	for _, test := range []struct {
+		tls      *tls.ConnectionState
+		expected int
+	}{
+		{tls: nil, expected: 1},
+		{tls: &tls.ConnectionState{}, expected: 0},
+	} {
+		core, logs := observer.New(zap.WarnLevel)
+		// connect_host_pattern that never matches, so that no connection is attempted
+		h := &Handler{logger: zap.New(core), connectHostPattern: regexp.MustCompile(`^$`)}
+		for i := 0; i < 3; i++ {
+			r := newTestRequest(http.MethodConnect, "example.com:443")
+			r.TLS = test.tls
+			h.ServeHTTP(httptest.NewRecorder(), r, next)
+		}
+		if logs.Len() != test.expected {
+			t.Fatalf("tls=%+v: expected %d warnings, got %d: %v", test.tls, test.expected, logs.Len(), logs.All())
+		}
+	}
+}
+
+// hijackableRecorder is a ResponseRecorder that hands out conn when hijacked.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (hr hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hr.conn, nil, nil
+}
+
+func TestHijackClientGone(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	h := Handler{logger: zap.New(core)}
+
+	clientConn, clientPeer := net.Pipe()
+	clientPeer.Close() // client closes connection before response is written
+	targetConn, targetPeer := net.Pipe()
+	defer targetPeer.Close()
+
+	err := h.serveHijack(hijackableRecorder{httptest.NewRecorder(), clientConn}, targetConn)
+	if err != nil {
+		t.Fatal("expected gone client to not be an error, got:", err)
+	}
+	if logs.FilterMessage("client went away before CONNECT response was sent").Len() != 1 {
+		t.Fatalf("expected client gone debug log, got: %v", logs.All())
+	}
+}
+
+// tcpOptionsRecorder records TCP options applied to it.
+type tcpOptionsRecorder struct {
+	net.Conn
+	noDelay         *bool
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+}
+
+func (c *tcpOptionsRecorder) SetNoDelay(noDelay bool) error {
+	c.noDelay = &noDelay
+	return nil
+}
+
+func (c *tcpOptionsRecorder) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
+
+func (c *tcpOptionsRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return nil
+}
+
+// netConnWrapper mimics *tls.Conn exposing its underlying connection.
+type netConnWrapper struct {
+	net.Conn
+}
+
+func (c netConnWrapper) NetConn() net.Conn {
+	return c.Conn
+}
+
+func TestApplyTCPOptions(t *testing.T) {
+	noDelay := false
+	h := Handler{logger: zap.NewNop(), TCPNoDelay: &noDelay, TCPKeepAlive: caddy.Duration(15 * time.Second)}
+
+	conn := &tcpOptionsRecorder{}
+	h.applyTCPOptions(conn)
+	if conn.noDelay == nil || *conn.noDelay != false {
+		t.Fatal("expected TCP_NODELAY to be disabled")
+	}
+	if !conn.keepAlive || conn.keepAlivePeriod != 15*time.Second {
+		t.Fatalf("expected keep-alive with 15s period, got: %v %v", conn.keepAlive, conn.keepAlivePeriod)
+	}
+
+	conn = &tcpOptionsRecorder{}
+	h.applyTCPOptions(netConnWrapper{conn})
+	if conn.noDelay == nil || !conn.keepAlive {
+		t.Fatal("expected TCP options to be applied to the wrapped connection")
+	}
+
+	conn = &tcpOptionsRecorder{}
+	Handler{logger: zap.NewNop()}.applyTCPOptions(conn)
+	if conn.noDelay != nil || conn.keepAlive || conn.keepAlivePeriod != 0 {
+		t.Fatal("expected no TCP options to be applied by default")
+	}
+}
+
+func TestMaxBufferedBody(t *testing.T) {
+	errDial := errors.New("test dial")
+	h := &Handler{
+		logger:          zap.NewNop(),
+		MaxBufferedBody: 16,
+		httpTransport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, errDial
+			},
+		},
+	}
+	for _, test := range []struct {
+		body       string
+		statusCode int
+	}{
+		{body: "", statusCode: http.StatusBadGateway},
+		{body: "sixteen bytes!!!", statusCode: http.StatusBadGateway}, // passed on to (failing) transport
+		{body: "seventeen bytes!!", statusCode: http.StatusRequestEntityTooLarge},
+	} {
+		r := newTestRequest(http.MethodGet, "http://example.com/")
+		r.Body = ioutil.NopCloser(strings.NewReader(test.body))
+		err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != test.statusCode {
+			t.Fatalf("body of %d bytes: expected %d error, got: %v", len(test.body), test.statusCode, err)
+		}
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	h := Handler{authCredentials: [][]byte{[]byte("dGVzdDpwYXNz")}}
+	for _, test := range []struct {
+		header string
+		err    error
+	}{
+		{header: credentialsCorrect, err: nil},
+		{header: "bAsIc dGVzdDpwYXNz", err: nil},
+		{header: "", err: errNoProxyAuthorization},
+		{header: "Tssssssss", err: errNoProxyAuthorization},
+		{header: "Basic dpz3 asp", err: errNoProxyAuthorization},
+		{header: "Foo bar", err: errAuthTypeNotSupported},
+		{header: "Basi\xc3 dGVzdDpwYXNz", err: errAuthTypeNotSupported},
+		{header: "Basic ", err: errInvalidCredentials},
+		{header: "Basic dzp3", err: errInvalidCredentials},
+	} {
+		r := newTestRequest(http.MethodGet, "http://example.com/")
+		if test.header != "" {
+			r.Header.Set("Proxy-Authorization", test.header)
+		}
+		if err := h.checkCredentials(r); err != test.err {
+			t.Fatalf("Proxy-Authorization %q: expected %v, got %v", test.header, test.err, err)
+		}
+	}
+}
+
+// Requests without credentials to a proxy with probe resistance are the most common ones:
+// they belong to the website and should be passed to next handler as cheaply as possible.
+func BenchmarkServeHTTPReject(b *testing.B) {
+	h := &Handler{
+		logger:          zap.NewNop(),
+		Hosts:           caddyhttp.MatchHost{"proxy.example.com"},
+		ProbeResistance: &ProbeResistance{Domain: "secret.example.com"},
+		authRequired:    true,
+		authCredentials: [][]byte{[]byte("dGVzdDpwYXNz")},
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	r := newTestRequest(http.MethodGet, "https://proxy.example.com/index.html")
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := h.ServeHTTP(w, r, next); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	h := Handler{ReadTimeout: caddy.Duration(50 * time.Millisecond)}
+	conn = h.withTimeouts(conn)
+	defer conn.Close()
+
+	go peer.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal("read within timeout failed:", err)
+	}
+
+	start := time.Now()
+	_, err := conn.Read(buf) // peer never writes again
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("expected stalled read to time out, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("stalled read was aborted too late:", elapsed)
+	}
+
+	if _, ok := (Handler{}).withTimeouts(peer).(*timeoutConn); ok {
+		t.Fatal("expected connection to not be wrapped when no timeouts are configured")
+	}
+}
+
+func TestUpstreamPreface(t *testing.T) {
+	const preface = "MAGIC\x00\r\n"
+	received := make(chan []byte, 1)
+	h := Handler{
+		logger:          zap.NewNop(),
+		accessLogger:    zap.NewNop(),
+		UpstreamPreface: preface,
+		aclRules:        []aclRule{&aclAllRule{allow: true}},
+		resolver:        &countingResolver{},
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			go func() {
+				defer peer.Close()
+				buf := make([]byte, len(preface))
+				io.ReadFull(peer, buf)
+				received <- buf
+			}()
+			return conn, nil
+		},
+	}
+	r := newTestRequest(http.MethodConnect, "example.com:443")
+	r.ProtoMajor = 2
+	if err := h.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buf := <-received; string(buf) != preface {
+		t.Fatalf("expected target to receive preface first, got: %q", buf)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	h := Handler{
+		logger:       zap.NewNop(),
+		accessLogger: zap.New(core).Named("access"),
+		aclRules:     []aclRule{&aclAllRule{allow: true}},
+		resolver:     &countingResolver{},
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			peer.Close() // target closes the tunnel right away
+			return conn, nil
+		},
+	}
+	r := newTestRequest(http.MethodConnect, "example.com:443")
+	r.ProtoMajor = 2
+	if err := h.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := logs.AllUntimed()
+	if len(entries) != 2 || entries[0].Message != "tunnel established" || entries[1].Message != "tunnel closed" {
+		t.Fatalf("expected tunnel establishment and closure to be logged, got: %v", entries)
+	}
+	for _, entry := range entries {
+		if entry.LoggerName != "access" || entry.ContextMap()["target"] != "example.com:443" {
+			t.Fatalf("unexpected access log entry: %v", entry)
+		}
+	}
+	if _, ok := entries[1].ContextMap()["duration"]; !ok {
+		t.Fatal("expected tunnel closure to log duration")
+	}
+	if reason := entries[1].ContextMap()["close_reason"]; reason != "closed" {
+		t.Fatal("expected tunnel closed by target to be logged as closed, got:", reason)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCloseReason(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		reason string
+	}{
+		{err: nil, reason: "closed"},
+		{err: io.EOF, reason: "closed"},
+		{err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, reason: "reset"},
+		{err: &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, reason: "reset"},
+		{err: &net.OpError{Op: "read", Err: timeoutError{}}, reason: "timeout"},
+		{err: errByteLimitReached, reason: "byte_limit"},
+		{err: errors.New("http2: stream closed"), reason: "error"},
+	} {
+		if reason := closeReason(test.err); reason != test.reason {
+			t.Fatalf("%v: expected close reason %s, got: %s", test.err, test.reason, reason)
+		}
+	}
+}
+
+// noDeadlineConn ignores deadlines, like a target that never times out on its own.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (noDeadlineConn) SetReadDeadline(time.Time) error  { return nil }
+func (noDeadlineConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestAccessLogTimeout(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	targetPeers := make(chan net.Conn, 1)
+	h := Handler{
+		logger:       zap.NewNop(),
+		accessLogger: zap.New(core),
+		ReadTimeout:  caddy.Duration(50 * time.Millisecond),
+		aclRules:     []aclRule{&aclAllRule{allow: true}},
+		resolver:     &countingResolver{},
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			targetPeers <- peer // target stays idle
+			return noDeadlineConn{conn}, nil
+		},
+	}
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+	go io.Copy(ioutil.Discard, clientPeer) // client reads the response, then stays idle
+
+	r := newTestRequest(http.MethodConnect, "example.com:443")
+	done := make(chan error)
+	go func() { done <- h.ServeHTTP(hijackableRecorder{httptest.NewRecorder(), clientConn}, r, nil) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle tunnel was not torn down")
+	}
+	(<-targetPeers).Close()
+
+	closed := logs.FilterMessage("tunnel closed").AllUntimed()
+	if len(closed) != 1 {
+		t.Fatalf("expected tunnel closure to be logged, got: %v", logs.AllUntimed())
+	}
+	if reason := closed[0].ContextMap()["close_reason"]; reason != "timeout" {
+		t.Fatal("expected idle tunnel to be logged as timed out, got:", reason)
+	}
+}
+
+func TestAccessLogClientHostname(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	h := Handler{
+		logger:       zap.NewNop(),
+		accessLogger: zap.New(core),
+		aclRules:     []aclRule{&aclAllRule{allow: true}},
+		resolver:     &countingResolver{},
+		ptrCache:     newPTRCache(&stubAddrResolver{names: map[string][]string{"192.0.2.1": {"client.example.net."}}}),
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			peer.Close()
+			return conn, nil
+		},
+	}
+	r := newTestRequest(http.MethodConnect, "example.com:443")
+	r.ProtoMajor = 2
+	r.RemoteAddr = "192.0.2.1:1234"
+	waitPTR(t, h.ptrCache, net.ParseIP("192.0.2.1"))
+	if err := h.ServeHTTP(httptest.NewRecorder(), r, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range logs.AllUntimed() {
+		if entry.ContextMap()["client_hostname"] != "client.example.net" {
+			t.Fatalf("expected access log entry to include client hostname, got: %v", entry)
+		}
+	}
+}
+
+func TestMaxPendingHandshakes(t *testing.T) {
+	dialing := make(chan struct{})
+	unblock := make(chan struct{})
+	h := Handler{
+		logger:            zap.NewNop(),
+		accessLogger:      zap.NewNop(),
+		aclRules:          []aclRule{&aclAllRule{allow: true}},
+		resolver:          &countingResolver{},
+		pendingHandshakes: make(chan struct{}, 1),
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialing <- struct{}{}
+			<-unblock
+			return nil, errors.New("test dial")
+		},
+	}
+	connect := func() error {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.ProtoMajor = 2
+		return h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	}
+
+	firstDone := make(chan error)
+	go func() { firstDone <- connect() }()
+	<-dialing
+	err := connect()
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("expected handshake over the limit to be rejected with 503, got:", err)
+	}
+
+	close(unblock)
+	<-firstDone
+	go func() { <-dialing }()
+	err = connect()
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode == http.StatusServiceUnavailable {
+		t.Fatal("expected finished handshake to free its slot, got:", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, syscall.ECONNRESET }
+func (failingReader) Close() error             { return nil }
+
+func TestDualStreamTeardown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	// client resets the connection, while the target would keep its side open forever
+	target, targetPeer := net.Pipe()
+	defer targetPeer.Close()
+	done := make(chan error)
+	go func() { done <- dualStream(target, failingReader{}, httptest.NewRecorder(), false) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not torn down after client failed")
+	}
+
+	// target closes the tunnel
+	target, targetPeer = net.Pipe()
+	clientConn, clientPeer := net.Pipe()
+	go func() { done <- dualStream(target, clientConn, clientConn, false) }()
+	targetPeer.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not torn down after target closed")
+	}
+	clientConn.Close() // as serveHijack does on return
+	clientPeer.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("leaked %d goroutines", n-goroutines)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	limitReached := false
+	conn = &byteLimitConn{Conn: conn, remaining: 10, onLimit: func() { limitReached = true }}
+
+	go peer.Write([]byte("0123456"))
+	buf := make([]byte, 16)
+	n, err := io.ReadAtLeast(conn, buf, 7)
+	if err != nil || n != 7 {
+		t.Fatalf("read within limit failed: %d, %v", n, err)
+	}
+
+	go io.Copy(ioutil.Discard, peer)
+	n, err = conn.Write([]byte("789abc"))
+	if n != 3 || err != errByteLimitReached {
+		t.Fatalf("expected write to be cut at the limit after 3 bytes, got: %d, %v", n, err)
+	}
+	if !limitReached {
+		t.Fatal("expected tunnel to be closed when limit was reached")
+	}
+	if _, err = conn.Read(buf); err != errByteLimitReached {
+		t.Fatal("expected reads past the limit to fail, got:", err)
+	}
+	if _, err = peer.Write([]byte("x")); err == nil {
+		t.Fatal("expected underlying connection to be closed")
+	}
+}
+
+func TestMaxBytesAccessLog(t *testing.T) {
+	payload := []byte(strings.Repeat("x", 64))
+	for _, upload := range []bool{false, true} {
+		core, logs := observer.New(zap.InfoLevel)
+		targetPeers := make(chan net.Conn, 1)
+		h := Handler{
+			logger:       zap.NewNop(),
+			accessLogger: zap.New(core),
+			MaxBytes:     10,
+			aclRules:     []aclRule{&aclAllRule{allow: true}},
+			resolver:     &countingResolver{},
+			dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, peer := net.Pipe()
+				targetPeers <- peer
+				return conn, nil
+			},
+		}
+		clientConn, clientPeer := net.Pipe()
+		go io.Copy(ioutil.Discard, clientPeer)
+
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		done := make(chan error)
+		go func() { done <- h.ServeHTTP(hijackableRecorder{httptest.NewRecorder(), clientConn}, r, nil) }()
+		targetPeer := <-targetPeers
+		if upload {
+			go io.Copy(ioutil.Discard, targetPeer)
+			go clientPeer.Write(payload)
+		} else {
+			go targetPeer.Write(payload)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel was not torn down at the byte limit")
+		}
+		targetPeer.Close()
+		clientPeer.Close()
+
+		closed := logs.FilterMessage("tunnel closed").AllUntimed()
+		if len(closed) != 1 {
+			t.Fatalf("expected tunnel closure to be logged, got: %v", logs.AllUntimed())
+		}
+		if reason := closed[0].ContextMap()["close_reason"]; reason != "byte_limit" {
+			t.Fatalf("upload=%v: expected tunnel over max_bytes to be logged as byte_limit, got: %s", upload, reason)
+		}
+	}
+}
+
+func TestMaxTunnels(t *testing.T) {
+	h := &Handler{
+		logger:      zap.NewNop(),
+		tunnelSlots: make(chan struct{}, 1),
+		aclRules:    []aclRule{&aclAllRule{allow: true}},
+		resolver:    &countingResolver{},
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("test dial")
+		},
+	}
+	h.tunnelSlots <- struct{}{}
+
+	// the limit is shared by all clients
+	for _, remoteAddr := range []string{"192.0.2.1:1234", "198.51.100.1:1234"} {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.RemoteAddr = remoteAddr
+		err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("%s: expected tunnel over the limit to be rejected with 429, got: %v", remoteAddr, err)
+		}
+	}
+
+	// gets through, but fails to dial
+	<-h.tunnelSlots
+	err := h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodConnect, "example.com:443"), nil)
+	if herr, ok := err.(caddyhttp.HandlerError); ok && herr.StatusCode == http.StatusTooManyRequests {
+		t.Fatal("expected tunnel within the limit to be allowed, got:", err)
+	}
+	if len(h.tunnelSlots) != 0 {
+		t.Fatal("expected slot of finished tunnel to be freed")
+	}
+}
+
+func TestRequiredHeaders(t *testing.T) {
+	h := &Handler{
+		logger: zap.NewNop(),
+		RequiredHeaders: []RequiredHeader{
+			{Name: "X-Marker"},
+			{Name: "X-Client", Value: "naive"},
+		},
+	}
+	for _, test := range []struct {
+		header http.Header
+		ok     bool
+	}{
+		{header: http.Header{"X-Marker": {"1"}, "X-Client": {"naive"}}, ok: true},
+		{header: http.Header{"X-Marker": {""}, "X-Client": {"other", "naive"}}, ok: true},
+		{header: http.Header{"X-Client": {"naive"}}, ok: false},
+		{header: http.Header{"X-Marker": {"1"}}, ok: false},
+		{header: http.Header{"X-Marker": {"1"}, "X-Client": {"Naive"}}, ok: false},
+	} {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.Header = test.header
+		if err := h.checkRequiredHeaders(r); (err == nil) != test.ok {
+			t.Fatalf("headers %v: expected ok=%v, got: %v", test.header, test.ok, err)
+		}
+	}
+
+	nextCalled := false
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		nextCalled = true
+		return nil
+	})
+	err := h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodConnect, "example.com:443"), next)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusBadRequest || nextCalled {
+		t.Fatal("expected request without required headers to be rejected with 400, got:", err)
+	}
+
+	// with probe resistance, requests without required headers pass through
+	h.ProbeResistance = &ProbeResistance{}
+	err = h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodConnect, "example.com:443"), next)
+	if err != nil || !nextCalled {
+		t.Fatal("expected request without required headers to be passed to next handler, got:", err)
+	}
+}
+
+func TestRequiredHeaderPlaceholder(t *testing.T) {
+	os.Setenv("FORWARDPROXY_TEST_MARKER", "kWWL9Q")
+	defer os.Unsetenv("FORWARDPROXY_TEST_MARKER")
+
+	h := &Handler{
+		logger:          zap.NewNop(),
+		RequiredHeaders: []RequiredHeader{{Name: "X-Marker", Value: "{env.FORWARDPROXY_TEST_MARKER}"}},
+	}
+	for value, ok := range map[string]bool{
+		"kWWL9Q":                         true,
+		"{env.FORWARDPROXY_TEST_MARKER}": false,
+		"":                               false,
+	} {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.Header.Set("X-Marker", value)
+		if err := h.checkRequiredHeaders(r); (err == nil) != ok {
+			t.Fatalf("header value %q: expected ok=%v, got: %v", value, ok, err)
+		}
+	}
+}
+
+func TestIsValidHost(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"example.com":                     true,
+		"www.Example.COM.":                true,
+		"_dmarc.example-1.com":            true,
+		"localhost":                       true,
+		"192.0.2.1":                       true,
+		"2001:db8::1":                     true,
+		strings.Repeat("a", 63) + ".com":  true,
+		strings.Repeat("a", 64) + ".com":  false,
+		strings.Repeat("a.", 127) + "com": false,
+		"":                                false,
+		".":                               false,
+		"example..com":                    false,
+		".example.com":                    false,
+		"-example.com":                    false,
+		"example-.com":                    false,
+		"exa mple.com":                    false,
+		"example.com/path":                false,
+		"user@example.com":                false,
+		"ex\x00ample.com":                 false,
+		"пример.рф":                       false,
+		"fe80::1%eth0":                    false,
+	} {
+		if isValidHost(host) != valid {
+			t.Fatalf("%q: expected valid=%v", host, valid)
+		}
+	}
+
+	h := &Handler{logger: zap.NewNop()}
+	for _, target := range []string{"exa_mple..com:443", "example.com"} {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.URL.Host = target
+		err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected malformed target to be rejected with 400, got: %v", target, err)
+		}
+	}
+}
+
+func TestConnectTargetUserinfo(t *testing.T) {
+	var dialed string
+	h := &Handler{
+		logger:       zap.NewNop(),
+		accessLogger: zap.NewNop(),
+		aclRules:     []aclRule{&aclAllRule{allow: true}},
+		resolver:     &countingResolver{},
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = address
+			return nil, errors.New("test dial")
+		},
+	}
+	newRequests := func() map[string]*http.Request {
+		// HTTP/1.1 request line; net/http moves userinfo to r.URL.User
+		http1 := newTestRequest(http.MethodConnect, "user:pass@example.com:443")
+		// HTTP/2 :authority is kept verbatim
+		http2 := newTestRequest(http.MethodConnect, "example.com:443")
+		http2.ProtoMajor = 2
+		http2.URL = &url.URL{Host: "user:p@ss@example.com:443"}
+		return map[string]*http.Request{"HTTP/1.1": http1, "HTTP/2": http2}
+	}
+
+	for proto, r := range newRequests() {
+		err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusBadRequest || dialed != "" {
+			t.Fatalf("%s: expected target with credentials to be rejected with 400, got: %v", proto, err)
+		}
+	}
+
+	h.StripUserinfo = true
+	for proto, r := range newRequests() {
+		dialed = ""
+		if proto == "HTTP/1.1" {
+			// hijacking is not supported by the recorder; the dial is what matters
+			r.ProtoMajor = 2
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r, nil)
+		if dialed != "192.0.2.1:443" {
+			t.Fatalf("%s: expected credentials to be stripped before connecting to example.com, dialed: %q", proto, dialed)
+		}
+	}
+}
+
+func TestRequireSNIMatch(t *testing.T) {
+	for _, test := range []struct {
+		target string
+		sni    string
+		tls    bool
+		ok     bool
+	}{
+		{target: "example.com:443", sni: "example.com", tls: true, ok: true},
+		{target: "Example.COM.:8443", sni: "example.com", tls: true, ok: true},
+		{target: "caddyserver.com:443", sni: "example.com", tls: true, ok: false},
+		{target: "www.example.com:443", sni: "example.com", tls: true, ok: false},
+		{target: "example.com:443", sni: "", tls: true, ok: false},
+		{target: "example.com:443", tls: false, ok: false},
+	} {
+		r := newTestRequest(http.MethodConnect, test.target)
+		if test.tls {
+			r.TLS = &tls.ConnectionState{ServerName: test.sni}
+		}
+		host, _, _ := net.SplitHostPort(test.target)
+		if ok := matchesSNI(r, host); ok != test.ok {
+			t.Fatalf("target %s, SNI %q (TLS: %v): expected match=%v", test.target, test.sni, test.tls, test.ok)
+		}
+	}
+
+	h := &Handler{logger: zap.NewNop(), RequireSNIMatch: true}
+	r := newTestRequest(http.MethodConnect, "caddyserver.com:443")
+	r.TLS = &tls.ConnectionState{ServerName: "example.com"}
+	err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusForbidden {
+		t.Fatal("expected CONNECT to a different name than SNI to be rejected with 403, got:", err)
+	}
+
+	// plain proxy requests are checked too; a body over the limit marks a request that got through
+	h.MaxBufferedBody = 1
+	for _, test := range []struct {
+		target string
+		tls    bool
+		status int
+	}{
+		{target: "http://caddyserver.com/", tls: true, status: http.StatusForbidden},
+		{target: "http://example.com/", tls: false, status: http.StatusForbidden},
+		{target: "http://example.com:8080/", tls: true, status: http.StatusRequestEntityTooLarge},
+	} {
+		r := newTestRequest(http.MethodGet, test.target)
+		r.Body = ioutil.NopCloser(strings.NewReader("body"))
+		if test.tls {
+			r.TLS = &tls.ConnectionState{ServerName: "example.com"}
+		}
+		err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+		if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != test.status {
+			t.Fatalf("GET %s (TLS: %v): expected %d, got: %v", test.target, test.tls, test.status, err)
+		}
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	nginx, empty := "nginx", ""
+	for _, test := range []struct {
+		serverHeader *string
+		expected     []string
+	}{
+		{serverHeader: nil, expected: []string{"Caddy"}},
+		{serverHeader: &nginx, expected: []string{"nginx"}},
+		{serverHeader: &empty, expected: nil},
+	} {
+		h := Handler{
+			logger:       zap.NewNop(),
+			accessLogger: zap.NewNop(),
+			ServerHeader: test.serverHeader,
+			aclRules:     []aclRule{&aclAllRule{allow: true}},
+			resolver:     &countingResolver{},
+			dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, peer := net.Pipe()
+				peer.Close()
+				return conn, nil
+			},
+		}
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.ProtoMajor = 2
+		w := httptest.NewRecorder()
+		w.Header().Set("Server", "Caddy") // as set by Caddy's server
+		if err := h.ServeHTTP(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+		if server := w.Result().Header.Values("Server"); !reflect.DeepEqual(server, test.expected) {
+			t.Fatalf("server_header %v: expected Server header %v, got: %v", test.serverHeader, test.expected, server)
+		}
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	if _, err := parseTLSVersion("1.1"); err == nil {
+		t.Fatal("expected TLS 1.1 to be rejected as min_tls_version")
+	}
+	minVersion, err := parseTLSVersion("1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{logger: zap.NewNop(), minTLSVersion: minVersion}
+	for _, test := range []struct {
+		tls *tls.ConnectionState
+		ok  bool
+	}{
+		{tls: nil, ok: false},
+		{tls: &tls.ConnectionState{Version: tls.VersionTLS12}, ok: false},
+		{tls: &tls.ConnectionState{Version: tls.VersionTLS13}, ok: true},
+	} {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.TLS = test.tls
+		if err := h.checkTLSVersion(r); (err == nil) != test.ok {
+			t.Fatalf("TLS state %+v: expected ok=%v, got: %v", test.tls, test.ok, err)
+		}
+	}
+	if err := (Handler{}).checkTLSVersion(newTestRequest(http.MethodConnect, "example.com:443")); err != nil {
+		t.Fatal("expected any version to be accepted by default, got:", err)
+	}
+
+	r := newTestRequest(http.MethodConnect, "example.com:443")
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS12}
+	err = h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusForbidden {
+		t.Fatal("expected request over TLS 1.2 to be rejected with 403, got:", err)
+	}
+}
+
+func TestRandomDelay(t *testing.T) {
+	if d := (Handler{}).randomDelay(); d != 0 {
+		t.Fatal("expected no delay by default, got:", d)
+	}
+
+	h := Handler{RandomDelay: caddy.Duration(50 * time.Millisecond)}
+	var minDelay, maxDelay time.Duration = time.Hour, 0
+	for i := 0; i < 10000; i++ {
+		d := h.randomDelay()
+		if d < 0 || d >= 50*time.Millisecond {
+			t.Fatal("delay out of bounds:", d)
+		}
+		if d < minDelay {
+			minDelay = d
+		}
+		if d > maxDelay {
+			maxDelay = d
+		}
+	}
+	if minDelay > 5*time.Millisecond || maxDelay < 45*time.Millisecond {
+		t.Fatalf("delays are not spread over the whole range: min %v, max %v", minDelay, maxDelay)
+	}
+}
@@ -0,0 +1,121 @@
+//go:build go1.18
+// +build go1.18
+
+package forwardproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Neither fuzz target can run in this module as it is: testing.F needs Go 1.18,
+// while caddy's qtls-go1-15 dependency panics at init with anything but Go 1.15.
+
+// FuzzConnectTarget feeds arbitrary targets of HTTP/1.1 and HTTP/2 CONNECT requests to connectTarget,
+// and checks that only well-formed targets on allowed ports get through.
+func FuzzConnectTarget(f *testing.F) {
+	for _, seed := range []string{
+		"example.com:443", "user:pass@example.com:443", "@example.com:443", "a@b@example.com:443",
+		"[2001:db8::1]:443", "[fe80::1%eth0]:80", "example.com", ":443", "exa mple.com:80", "example.com:25",
+		"alias.example.com:443", "alias.example.net:443", "user@alias.example.com:443", "example.com:443\r\nX: y",
+	} {
+		f.Add(seed, false, false)
+		f.Add(seed, true, true)
+	}
+
+	aliases := map[string]string{"alias.example.com:443": "192.0.2.10:8443", "alias.example.net": "192.0.2.11:22"}
+	f.Fuzz(func(t *testing.T, target string, stripUserinfo, strictAliases bool) {
+		h := Handler{
+			StripUserinfo:       stripUserinfo,
+			Aliases:             aliases,
+			StrictAliases:       strictAliases,
+			BlockDangerousPorts: true,
+			DangerousPorts:      defaultDangerousPorts,
+		}
+		requests := []*http.Request{
+			// HTTP/2 and HTTP/3 requests carry the :authority as is
+			{Method: http.MethodConnect, Host: target, URL: &url.URL{Host: target}, ProtoMajor: 2},
+		}
+		// HTTP/1.1 requests are parsed by net/http first
+		raw := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"
+		if r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			requests = append(requests, r)
+		}
+
+		for _, r := range requests {
+			hostPort, err := h.connectTarget(r)
+			if err != nil {
+				if _, ok := err.(caddyhttp.HandlerError); !ok {
+					t.Fatalf("expected HandlerError for target %q, got: %v", target, err)
+				}
+				continue
+			}
+			host, port, err := net.SplitHostPort(hostPort)
+			if err != nil || !isValidHost(host) {
+				t.Fatalf("malformed target %q accepted as %q", target, hostPort)
+			}
+			if !h.portIsAllowed(port) {
+				t.Fatalf("target %q accepted as %q on forbidden port", target, hostPort)
+			}
+			if !stripUserinfo && strings.Contains(target, "@") {
+				t.Fatalf("target %q with userinfo accepted as %q", target, hostPort)
+			}
+			isAlias := false
+			for _, a := range aliases {
+				isAlias = isAlias || hostPort == a
+			}
+			if strictAliases && !isAlias {
+				t.Fatalf("target %q accepted as %q, which is not an alias", target, hostPort)
+			}
+		}
+	})
+}
+
+// FuzzDialContextCheckACL feeds arbitrary CONNECT targets to dialContextCheckACL, which parses and validates
+// them, and checks that only well-formed addresses are ever dialed.
+func FuzzDialContextCheckACL(f *testing.F) {
+	for _, seed := range []string{
+		"example.com:443", "example.com.:443", "[2001:db8::1]:443", "[fe80::1%eth0]:80", "192.0.2.1:0",
+		"example.com", "example.com:", ":443", "[::1]", "example.com:65536", "example.com:-1", "exa mple.com:80",
+		"xn--n3h.com:443", "user:pass@example.com:443", "[[::1]]:80", "example.com:443:443",
+	} {
+		f.Add(seed)
+	}
+
+	errDial := errors.New("test dial")
+	f.Fuzz(func(t *testing.T, hostPort string) {
+		h := Handler{
+			aclRules: []aclRule{&aclAllRule{allow: true}},
+			resolver: &countingResolver{},
+			dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(address)
+				if err != nil {
+					t.Fatalf("dialed malformed address %q for target %q: %v", address, hostPort, err)
+				}
+				if net.ParseIP(host) == nil {
+					t.Fatalf("dialed unresolved host %q for target %q", host, hostPort)
+				}
+				if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+					t.Fatalf("dialed invalid port %q for target %q", port, hostPort)
+				}
+				return nil, errDial
+			},
+		}
+		conn, err := h.dialContextCheckACL(context.Background(), "tcp", hostPort)
+		if conn != nil {
+			t.Fatalf("unexpected connection for target %q", hostPort)
+		}
+		if _, ok := err.(caddyhttp.HandlerError); !ok {
+			t.Fatalf("expected HandlerError for target %q, got: %v", hostPort, err)
+		}
+	})
+}
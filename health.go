@@ -0,0 +1,247 @@
+package forwardproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Rejections are counted in this many buckets of rejectionBucketSize each.
+const (
+	rejectionBuckets    = 5
+	rejectionBucketSize = time.Minute
+)
+
+// HealthSummary is a snapshot of the tunnel subsystem of a Handler.
+type HealthSummary struct {
+	// Number of open CONNECT tunnels.
+	ActiveTunnels int `json:"active_tunnels"`
+
+	// Number of CONNECT requests that are waiting for their target to be dialed.
+	PendingHandshakes int `json:"pending_handshakes"`
+
+	// Numbers of CONNECT requests rejected within the last 5 minutes, by reason.
+	Rejections map[string]int `json:"rejections"`
+
+	// Capacity limits that are currently reached, by their Caddyfile subdirective.
+	// While a limit is reached, it rejects at least some new tunnels.
+	LimitsTripped []string `json:"limits_tripped"`
+}
+
+// TunnelInfo describes an open CONNECT tunnel.
+type TunnelInfo struct {
+	// The host:port the tunnel leads to, after resolving aliases.
+	Target string `json:"target"`
+
+	// IP address of the client, with regard to TrustedProxies.
+	ClientIP string `json:"client_ip"`
+
+	// Name of the authenticated user, if authentication is required.
+	User string `json:"user,omitempty"`
+
+	// When the connection to the target was established.
+	Started time.Time `json:"started"`
+}
+
+type rejectionBucket struct {
+	start  time.Time
+	counts map[string]int
+}
+
+// tunnelStats is a concurrency-safe tracker of tunnel activity.
+type tunnelStats struct {
+	pending int64 // accessed atomically
+
+	now        func() time.Time
+	mu         sync.Mutex
+	rejections [rejectionBuckets]rejectionBucket
+	nextID     uint64
+	tunnels    map[uint64]TunnelInfo
+}
+
+func newTunnelStats() *tunnelStats {
+	return &tunnelStats{now: time.Now, tunnels: make(map[uint64]TunnelInfo)}
+}
+
+// open registers an established tunnel and returns its ID for close.
+func (s *tunnelStats) open(info TunnelInfo) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.tunnels[s.nextID] = info
+	return s.nextID
+}
+
+// close unregisters a tunnel registered by open.
+func (s *tunnelStats) close(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tunnels, id)
+}
+
+// activeTunnels returns copies of registered tunnels, oldest first.
+func (s *tunnelStats) activeTunnels() []TunnelInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]uint64, 0, len(s.tunnels))
+	for id := range s.tunnels {
+		ids = append(ids, id)
+	}
+	// IDs are handed out in order of establishment
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	tunnels := make([]TunnelInfo, len(ids))
+	for i, id := range ids {
+		tunnels[i] = s.tunnels[id]
+	}
+	return tunnels
+}
+
+func (s *tunnelStats) activeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tunnels)
+}
+
+// reject counts a rejected CONNECT request.
+func (s *tunnelStats) reject(reason string) {
+	start := s.now().Truncate(rejectionBucketSize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.rejections[start.Unix()/int64(rejectionBucketSize/time.Second)%rejectionBuckets]
+	if !b.start.Equal(start) {
+		*b = rejectionBucket{start: start, counts: make(map[string]int)}
+	}
+	b.counts[reason]++
+}
+
+// recentRejections sums up rejections of buckets that are not outdated yet.
+func (s *tunnelStats) recentRejections() map[string]int {
+	oldest := s.now().Truncate(rejectionBucketSize).Add(-(rejectionBuckets - 1) * rejectionBucketSize)
+	counts := make(map[string]int)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.rejections {
+		if b.start.Before(oldest) {
+			continue
+		}
+		for reason, n := range b.counts {
+			counts[reason] += n
+		}
+	}
+	return counts
+}
+
+// rejectTunnel counts a CONNECT request rejected for reason, and returns err.
+func (h Handler) rejectTunnel(reason string, err error) error {
+	if h.stats != nil {
+		h.stats.reject(reason)
+	}
+	return err
+}
+
+// Health returns a summary of the current state of CONNECT tunnels.
+func (h *Handler) Health() HealthSummary {
+	summary := HealthSummary{Rejections: make(map[string]int), LimitsTripped: []string{}}
+	if h.stats != nil {
+		summary.ActiveTunnels = h.stats.activeCount()
+		summary.PendingHandshakes = int(atomic.LoadInt64(&h.stats.pending))
+		summary.Rejections = h.stats.recentRejections()
+	}
+	if h.pendingHandshakes != nil && len(h.pendingHandshakes) == cap(h.pendingHandshakes) {
+		summary.LimitsTripped = append(summary.LimitsTripped, "max_pending_handshakes")
+	}
+	if h.lookupLimiter != nil && h.lookupLimiter.saturated() {
+		summary.LimitsTripped = append(summary.LimitsTripped, "max_concurrent_lookups")
+	}
+	if h.tunnelSlots != nil && len(h.tunnelSlots) == cap(h.tunnelSlots) {
+		summary.LimitsTripped = append(summary.LimitsTripped, "max_tunnels")
+	}
+	if h.targetLimiter != nil && h.targetLimiter.saturated() {
+		summary.LimitsTripped = append(summary.LimitsTripped, "max_targets_per_client")
+	}
+	return summary
+}
+
+// ActiveTunnels returns a snapshot of open CONNECT tunnels, oldest first.
+func (h *Handler) ActiveTunnels() []TunnelInfo {
+	if h.stats == nil {
+		return []TunnelInfo{}
+	}
+	return h.stats.activeTunnels()
+}
+
+// provisionedHandlers are the handlers whose health is served by AdminHealth.
+var provisionedHandlers = struct {
+	sync.Mutex
+	handlers []*Handler
+}{}
+
+func registerHandler(h *Handler) {
+	provisionedHandlers.Lock()
+	defer provisionedHandlers.Unlock()
+	provisionedHandlers.handlers = append(provisionedHandlers.handlers, h)
+}
+
+func unregisterHandler(h *Handler) {
+	provisionedHandlers.Lock()
+	defer provisionedHandlers.Unlock()
+	for i, registered := range provisionedHandlers.handlers {
+		if registered == h {
+			provisionedHandlers.handlers = append(provisionedHandlers.handlers[:i], provisionedHandlers.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+// AdminHealth is an admin API module, that serves health summaries of
+// all forward_proxy handlers at /forward_proxy/health.
+type AdminHealth struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminHealth) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.forward_proxy",
+		New: func() caddy.Module { return new(AdminHealth) },
+	}
+}
+
+// Routes returns the admin routes of AdminHealth.
+func (AdminHealth) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: "/forward_proxy/health",
+		Handler: caddy.AdminHandlerFunc(serveHealth),
+	}}
+}
+
+// handlerHealth is the health summary of one of the handlers served by AdminHealth.
+type handlerHealth struct {
+	// Position of the handler among provisioned handlers, in order of provisioning.
+	Index int    `json:"index"`
+	Name  string `json:"name,omitempty"`
+	HealthSummary
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	provisionedHandlers.Lock()
+	handlers := append([]*Handler(nil), provisionedHandlers.handlers...)
+	provisionedHandlers.Unlock()
+
+	summaries := make([]handlerHealth, len(handlers))
+	for i, h := range handlers {
+		summaries[i] = handlerHealth{Index: i, Name: h.Name, HealthSummary: h.Health()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(summaries)
+}
@@ -0,0 +1,185 @@
+package forwardproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func waitHealth(t *testing.T, h *Handler, ok func(HealthSummary) bool) HealthSummary {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		summary := h.Health()
+		if ok(summary) {
+			return summary
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected health summary: %+v", summary)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	dialing := make(chan struct{})
+	targetPeers := make(chan net.Conn, 1)
+	h := &Handler{
+		logger:            zap.NewNop(),
+		accessLogger:      zap.NewNop(),
+		stats:             newTunnelStats(),
+		pendingHandshakes: make(chan struct{}, 1),
+		tunnelSlots:       make(chan struct{}, 1),
+		aclRules:          []aclRule{&aclAllRule{allow: true}},
+		resolver:          &countingResolver{},
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-dialing
+			conn, peer := net.Pipe()
+			targetPeers <- peer
+			return conn, nil
+		},
+	}
+	if summary := h.Health(); summary.ActiveTunnels != 0 || summary.PendingHandshakes != 0 ||
+		len(summary.Rejections) != 0 || len(summary.LimitsTripped) != 0 {
+		t.Fatalf("expected idle handler to report nothing, got: %+v", summary)
+	}
+
+	done := make(chan error)
+	go func() {
+		r := newTestRequest(http.MethodConnect, "example.com:443")
+		r.ProtoMajor = 2
+		done <- h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	}()
+	waitHealth(t, h, func(s HealthSummary) bool { return s.PendingHandshakes == 1 })
+
+	// rejected while the first handshake is pending
+	h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodConnect, "example.com:443"), nil)
+	summary := h.Health()
+	if !reflect.DeepEqual(summary.Rejections, map[string]int{"pending_handshakes": 1}) {
+		t.Fatal("expected rejection to be counted, got:", summary.Rejections)
+	}
+	if !reflect.DeepEqual(summary.LimitsTripped, []string{"max_pending_handshakes", "max_tunnels"}) {
+		t.Fatal("expected handshake and tunnel limits to be reached, got:", summary.LimitsTripped)
+	}
+
+	close(dialing)
+	targetPeer := <-targetPeers
+	summary = waitHealth(t, h, func(s HealthSummary) bool { return s.ActiveTunnels == 1 })
+	if summary.PendingHandshakes != 0 || !reflect.DeepEqual(summary.LimitsTripped, []string{"max_tunnels"}) {
+		t.Fatalf("expected established tunnel to no longer be pending, got: %+v", summary)
+	}
+
+	targetPeer.Close()
+	<-done
+	summary = h.Health()
+	if summary.ActiveTunnels != 0 || len(summary.LimitsTripped) != 0 {
+		t.Fatalf("expected closed tunnel to no longer count, got: %+v", summary)
+	}
+
+	now := time.Now()
+	h.stats.now = func() time.Time { return now }
+	now = now.Add(5 * time.Minute)
+	h.stats.reject("port")
+	if summary = h.Health(); !reflect.DeepEqual(summary.Rejections, map[string]int{"port": 1}) {
+		t.Fatal("expected only recent rejections to be counted, got:", summary.Rejections)
+	}
+}
+
+func TestActiveTunnels(t *testing.T) {
+	credentials := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	targetPeers := make(chan net.Conn, 2)
+	h := &Handler{
+		logger:          zap.NewNop(),
+		accessLogger:    zap.NewNop(),
+		stats:           newTunnelStats(),
+		authRequired:    true,
+		authCredentials: [][]byte{[]byte(credentials)},
+		aclRules:        []aclRule{&aclAllRule{allow: true}},
+		resolver:        &countingResolver{},
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, peer := net.Pipe()
+			targetPeers <- peer
+			return conn, nil
+		},
+	}
+	targets := []string{"example.com:443", "caddyserver.com:443"}
+	var peers []net.Conn
+	done := make(chan error)
+	for i, target := range targets {
+		r := newTestRequest(http.MethodConnect, target)
+		r.ProtoMajor = 2
+		r.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		go func() { done <- h.ServeHTTP(httptest.NewRecorder(), r, nil) }()
+		peers = append(peers, <-targetPeers)
+		waitHealth(t, h, func(s HealthSummary) bool { return s.ActiveTunnels == i+1 })
+	}
+
+	tunnels := h.ActiveTunnels()
+	if len(tunnels) != len(targets) {
+		t.Fatal("expected open tunnels to be listed, got:", tunnels)
+	}
+	for i, tunnel := range tunnels {
+		if tunnel.Target != targets[i] || tunnel.ClientIP != "192.0.2.1" || tunnel.User != "alice" || tunnel.Started.IsZero() {
+			t.Fatalf("unexpected tunnel %d: %+v", i, tunnel)
+		}
+	}
+	tunnels[0].Target = "modified.example.com:443"
+	if h.ActiveTunnels()[0].Target != targets[0] {
+		t.Fatal("expected snapshot to be a copy")
+	}
+
+	for _, peer := range peers {
+		peer.Close()
+		<-done
+	}
+	if tunnels = h.ActiveTunnels(); len(tunnels) != 0 {
+		t.Fatal("expected closed tunnels to be removed, got:", tunnels)
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	// other tests provision handlers too, so only the entry of h is checked
+	h := &Handler{Name: "admin-health-test", stats: newTunnelStats()}
+	h.stats.reject("acl")
+	registerHandler(h)
+	defer h.Cleanup()
+
+	find := func() *handlerHealth {
+		w := httptest.NewRecorder()
+		if err := serveHealth(w, httptest.NewRequest(http.MethodGet, "/forward_proxy/health", nil)); err != nil {
+			t.Fatal(err)
+		}
+		var summaries []handlerHealth
+		if err := json.NewDecoder(w.Body).Decode(&summaries); err != nil {
+			t.Fatal(err)
+		}
+		for i, summary := range summaries {
+			if summary.Index != i {
+				t.Fatalf("expected summary %d to have index %d, got: %d", i, i, summary.Index)
+			}
+			if summary.Name == h.Name {
+				return &summaries[i]
+			}
+		}
+		return nil
+	}
+	if summary := find(); summary == nil || summary.Rejections["acl"] != 1 {
+		t.Fatal("expected summary of the registered handler, got:", summary)
+	}
+
+	h.Cleanup()
+	if summary := find(); summary != nil {
+		t.Fatal("expected handler to be unregistered by Cleanup, got:", summary)
+	}
+
+	if err := serveHealth(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/forward_proxy/health", nil)); err == nil {
+		t.Fatal("expected only GET to be allowed")
+	}
+}
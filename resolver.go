@@ -0,0 +1,217 @@
+package forwardproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostResolver is implemented by *net.Resolver.
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Failed lookups are cached for at most this long.
+const dnsNegativeCacheTTL = 5 * time.Second
+
+// Expired entries are purged once the cache grows beyond this size.
+const dnsCachePurgeSize = 4096
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// dnsCache is a concurrency-safe hostResolver, that caches results of another hostResolver.
+type dnsCache struct {
+	resolver    hostResolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache(resolver hostResolver, ttl time.Duration) *dnsCache {
+	negativeTTL := dnsNegativeCacheTTL
+	if ttl < negativeTTL {
+		negativeTTL = ttl
+	}
+	return &dnsCache{
+		resolver:    resolver,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]dnsCacheEntry),
+	}
+}
+
+func (c *dnsCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.addrs, entry.err
+	}
+
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, errLookupLimit)) {
+		// lookup was cut short by the caller or never ran; says nothing about the host
+		return addrs, err
+	}
+	entry = dnsCacheEntry{addrs: addrs, err: err, expires: c.now().Add(c.ttl)}
+	if err != nil {
+		entry.expires = c.now().Add(c.negativeTTL)
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= dnsCachePurgeSize {
+		now := c.now()
+		for h, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, h)
+			}
+		}
+	}
+	c.entries[host] = entry
+	c.mu.Unlock()
+
+	return addrs, err
+}
+
+var errLookupLimit = errors.New("too many concurrent DNS lookups")
+
+// limitedResolver is a hostResolver, that limits concurrency of lookups of another hostResolver.
+type limitedResolver struct {
+	resolver hostResolver
+	slots    chan struct{}
+	wait     time.Duration // how long lookups may wait for a free slot
+}
+
+func newLimitedResolver(resolver hostResolver, max int, wait time.Duration) *limitedResolver {
+	return &limitedResolver{
+		resolver: resolver,
+		slots:    make(chan struct{}, max),
+		wait:     wait,
+	}
+}
+
+func (r *limitedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	timer := time.NewTimer(r.wait)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, errLookupLimit
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-r.slots }()
+	return r.resolver.LookupIPAddr(ctx, host)
+}
+
+// saturated reports whether all lookup slots are taken.
+func (r *limitedResolver) saturated() bool {
+	return len(r.slots) == cap(r.slots)
+}
+
+// lookupIP resolves host using configured resolver.
+func (h Handler) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	var resolver hostResolver = net.DefaultResolver
+	if h.resolver != nil {
+		resolver = h.resolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// addrResolver is implemented by *net.Resolver.
+type addrResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+const (
+	ptrLookupTimeout = 2 * time.Second
+	ptrCacheTTL      = 10 * time.Minute
+)
+
+type ptrCacheEntry struct {
+	name    string
+	pending bool
+	expires time.Time
+}
+
+// ptrCache looks up hostnames of IP addresses in background and caches them,
+// so that callers never wait for reverse DNS.
+type ptrCache struct {
+	resolver addrResolver
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]ptrCacheEntry
+}
+
+func newPTRCache(resolver addrResolver) *ptrCache {
+	return &ptrCache{
+		resolver: resolver,
+		now:      time.Now,
+		entries:  make(map[string]ptrCacheEntry),
+	}
+}
+
+// lookup returns cached hostname of ip, if any. If the hostname is not cached or has
+// expired, a lookup is started in background.
+func (c *ptrCache) lookup(ip net.IP) (string, bool) {
+	addr := ip.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[addr]
+	if ok && (entry.pending || c.now().Before(entry.expires)) {
+		return entry.name, entry.name != ""
+	}
+
+	if len(c.entries) >= dnsCachePurgeSize {
+		now := c.now()
+		for a, e := range c.entries {
+			if !e.pending && !now.Before(e.expires) {
+				delete(c.entries, a)
+			}
+		}
+	}
+	// a stale name is still better than none while it is being refreshed
+	c.entries[addr] = ptrCacheEntry{name: entry.name, pending: true}
+	go c.resolve(addr)
+	return entry.name, entry.name != ""
+}
+
+func (c *ptrCache) resolve(addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ptrLookupTimeout)
+	defer cancel()
+	entry := ptrCacheEntry{expires: c.now().Add(dnsNegativeCacheTTL)}
+	if names, err := c.resolver.LookupAddr(ctx, addr); err == nil && len(names) > 0 {
+		entry = ptrCacheEntry{name: strings.TrimSuffix(names[0], "."), expires: c.now().Add(ptrCacheTTL)}
+	}
+	c.mu.Lock()
+	c.entries[addr] = entry
+	c.mu.Unlock()
+}
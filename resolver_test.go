@@ -0,0 +1,258 @@
+package forwardproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// countingResolver resolves every host to 192.0.2.1, except hosts in fail, and counts lookups.
+type countingResolver struct {
+	mu      sync.Mutex
+	lookups map[string]int
+	fail    map[string]bool
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lookups == nil {
+		r.lookups = make(map[string]int)
+	}
+	r.lookups[host]++
+	if r.fail[host] {
+		return nil, errors.New("no such host")
+	}
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+}
+
+func TestDNSCache(t *testing.T) {
+	resolver := &countingResolver{fail: map[string]bool{"bad.example.com": true}}
+	cache := newDNSCache(resolver, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		addrs, err := cache.LookupIPAddr(context.Background(), "example.com")
+		if err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("unexpected lookup result: %v %v", addrs, err)
+		}
+		if _, err := cache.LookupIPAddr(context.Background(), "bad.example.com"); err == nil {
+			t.Fatal("expected failed lookup to be cached as failure")
+		}
+	}
+	if resolver.lookups["example.com"] != 1 || resolver.lookups["bad.example.com"] != 1 {
+		t.Fatalf("expected a single lookup per host within TTL, got: %v", resolver.lookups)
+	}
+
+	// negative entries expire first
+	now = now.Add(dnsNegativeCacheTTL)
+	cache.LookupIPAddr(context.Background(), "example.com")
+	cache.LookupIPAddr(context.Background(), "bad.example.com")
+	if resolver.lookups["example.com"] != 1 || resolver.lookups["bad.example.com"] != 2 {
+		t.Fatalf("expected only failed lookup to expire, got: %v", resolver.lookups)
+	}
+
+	now = now.Add(time.Minute)
+	cache.LookupIPAddr(context.Background(), "example.com")
+	if resolver.lookups["example.com"] != 2 {
+		t.Fatalf("expected lookup after TTL expired, got: %v", resolver.lookups)
+	}
+
+	// IP literals are never looked up
+	addrs, err := cache.LookupIPAddr(context.Background(), "2001:db8::1")
+	if err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected lookup result for IP literal: %v %v", addrs, err)
+	}
+	if resolver.lookups["2001:db8::1"] != 0 {
+		t.Fatal("IP literal was passed to resolver")
+	}
+}
+
+type stubAddrResolver struct {
+	mu      sync.Mutex
+	lookups int
+	names   map[string][]string
+}
+
+func (r *stubAddrResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if names, ok := r.names[addr]; ok {
+		return names, nil
+	}
+	return nil, errors.New("no PTR record")
+}
+
+// waitPTR starts lookup of ip, if needed, and waits for it to finish.
+func waitPTR(t *testing.T, cache *ptrCache, ip net.IP) (string, bool) {
+	cache.lookup(ip)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cache.mu.Lock()
+		entry := cache.entries[ip.String()]
+		cache.mu.Unlock()
+		if !entry.pending {
+			return cache.lookup(ip)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("reverse lookup did not finish in time")
+	return "", false
+}
+
+func TestPTRCache(t *testing.T) {
+	resolver := &stubAddrResolver{names: map[string][]string{"192.0.2.1": {"client.example.net."}}}
+	cache := newPTRCache(resolver)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	ip := net.ParseIP("192.0.2.1")
+	if _, ok := cache.lookup(ip); ok {
+		t.Fatal("expected first lookup to not wait for reverse DNS")
+	}
+	if name, ok := waitPTR(t, cache, ip); !ok || name != "client.example.net" {
+		t.Fatalf("expected cached hostname client.example.net, got: %q %v", name, ok)
+	}
+	if _, ok := waitPTR(t, cache, net.ParseIP("192.0.2.2")); ok {
+		t.Fatal("expected no hostname for address without PTR record")
+	}
+	cache.lookup(ip)
+	cache.lookup(net.ParseIP("192.0.2.2"))
+	if resolver.lookups != 2 {
+		t.Fatal("expected cached results to be reused, got lookups:", resolver.lookups)
+	}
+
+	// stale names are served while being refreshed
+	now = now.Add(ptrCacheTTL)
+	if name, ok := cache.lookup(ip); !ok || name != "client.example.net" {
+		t.Fatalf("expected stale hostname during refresh, got: %q %v", name, ok)
+	}
+	waitPTR(t, cache, ip)
+	if resolver.lookups != 3 {
+		t.Fatal("expected expired hostname to be looked up again, got lookups:", resolver.lookups)
+	}
+}
+
+// blockingResolver tracks concurrency of lookups, that block until released.
+type blockingResolver struct {
+	release chan struct{}
+
+	mu                sync.Mutex
+	active, maxActive int
+}
+
+func (r *blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	r.active++
+	if r.active > r.maxActive {
+		r.maxActive = r.active
+	}
+	r.mu.Unlock()
+	<-r.release
+	r.mu.Lock()
+	r.active--
+	r.mu.Unlock()
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+}
+
+func waitActive(r *blockingResolver, n int) {
+	for {
+		r.mu.Lock()
+		active := r.active
+		r.mu.Unlock()
+		if active == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimitedResolver(t *testing.T) {
+	blocking := &blockingResolver{release: make(chan struct{})}
+	resolver := newLimitedResolver(blocking, 3, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := resolver.LookupIPAddr(context.Background(), fmt.Sprintf("host%d.example.com", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	waitActive(blocking, 3)
+	time.Sleep(10 * time.Millisecond) // give excess lookups a chance to start
+	for i := 0; i < 10; i++ {
+		blocking.release <- struct{}{}
+	}
+	wg.Wait()
+	if blocking.maxActive != 3 {
+		t.Fatal("expected at most 3 concurrent lookups, got:", blocking.maxActive)
+	}
+
+	// lookups waiting for a slot time out
+	resolver = newLimitedResolver(blocking, 1, 10*time.Millisecond)
+	go resolver.LookupIPAddr(context.Background(), "slow.example.com")
+	defer func() { blocking.release <- struct{}{} }()
+	waitActive(blocking, 1)
+	if _, err := resolver.LookupIPAddr(context.Background(), "example.com"); err == nil {
+		t.Fatal("expected lookup to fail when no slot frees up in time")
+	}
+	if _, err := resolver.LookupIPAddr(context.Background(), "192.0.2.7"); err != nil {
+		t.Fatal("expected IP addresses to not need a slot, got:", err)
+	}
+}
+
+func TestDNSCacheOverLimitedResolver(t *testing.T) {
+	blocking := &blockingResolver{release: make(chan struct{})}
+	cache := newDNSCache(newLimitedResolver(blocking, 1, 10*time.Millisecond), time.Minute)
+	go cache.LookupIPAddr(context.Background(), "slow.example.com")
+	waitActive(blocking, 1)
+	if _, err := cache.LookupIPAddr(context.Background(), "example.com"); !errors.Is(err, errLookupLimit) {
+		t.Fatal("expected lookup to fail when no slot frees up in time, got:", err)
+	}
+
+	blocking.release <- struct{}{}
+	waitActive(blocking, 0)
+	go func() { blocking.release <- struct{}{} }()
+	if _, err := cache.LookupIPAddr(context.Background(), "example.com"); err != nil {
+		t.Fatal("expected lookup that didn't get a slot to be retried, got:", err)
+	}
+}
+
+func TestLookupWaitCountsTowardsDialTimeout(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	blocking := &blockingResolver{release: make(chan struct{})}
+	var remaining time.Duration
+	h := Handler{
+		DialTimeout: caddy.Duration(time.Minute),
+		aclRules:    []aclRule{&aclAllRule{allow: true}},
+		resolver:    newLimitedResolver(blocking, 1, time.Minute),
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if deadline, ok := ctx.Deadline(); ok {
+				remaining = time.Until(deadline)
+			}
+			return nil, errors.New("test dial")
+		},
+	}
+	go h.resolver.LookupIPAddr(context.Background(), "slow.example.com")
+	waitActive(blocking, 1)
+	go func() {
+		time.Sleep(wait)
+		blocking.release <- struct{}{}
+		blocking.release <- struct{}{}
+	}()
+	h.dialContextCheckACL(context.Background(), "tcp", "example.com:443")
+	if remaining <= 0 || remaining > time.Minute-wait {
+		t.Fatal("expected dial to get what is left of dial_timeout after waiting for a lookup slot, got:", remaining)
+	}
+}
@@ -0,0 +1,86 @@
+package forwardproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// targetLimiter limits how many distinct CONNECT targets each client may connect to
+// within a sliding window. Targets that a client already connected to within the
+// window remain allowed.
+type targetLimiter struct {
+	max    int
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]map[string]time.Time // client -> target -> expiration
+}
+
+func newTargetLimiter(max int, window time.Duration) *targetLimiter {
+	return &targetLimiter{
+		max:     max,
+		window:  window,
+		now:     time.Now,
+		clients: make(map[string]map[string]time.Time),
+	}
+}
+
+// allowed reports whether client may connect to target within the limit.
+func (l *targetLimiter) allowed(client, target string) bool {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	targets := l.clients[client]
+	if _, ok := targets[target]; ok {
+		return true
+	}
+	return expireTargets(targets, now) < l.max
+}
+
+// record counts target towards the limit of client. Concurrent connections to new targets
+// that were all allowed may overshoot the limit slightly.
+func (l *targetLimiter) record(client, target string) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.clients) >= dnsCachePurgeSize {
+		for c, targets := range l.clients {
+			if expireTargets(targets, now) == 0 {
+				delete(l.clients, c)
+			}
+		}
+	}
+
+	targets, ok := l.clients[client]
+	if !ok {
+		targets = make(map[string]time.Time)
+		l.clients[client] = targets
+	}
+	targets[target] = now.Add(l.window)
+}
+
+// saturated reports whether any client is at the limit of distinct targets.
+func (l *targetLimiter) saturated() bool {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, targets := range l.clients {
+		if expireTargets(targets, now) >= l.max {
+			return true
+		}
+	}
+	return false
+}
+
+// expireTargets deletes expired targets and returns the number of remaining ones.
+func expireTargets(targets map[string]time.Time, now time.Time) int {
+	for target, expires := range targets {
+		if !now.Before(expires) {
+			delete(targets, target)
+		}
+	}
+	return len(targets)
+}
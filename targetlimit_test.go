@@ -0,0 +1,121 @@
+package forwardproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestTargetLimiter(t *testing.T) {
+	l := newTargetLimiter(3, time.Minute)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	allow := func(client, target string) bool {
+		if !l.allowed(client, target) {
+			return false
+		}
+		l.record(client, target)
+		return true
+	}
+
+	for i := 0; i < 3; i++ {
+		if !allow("192.0.2.1", fmt.Sprintf("host%d.example.com:443", i)) {
+			t.Fatalf("expected target %d to be allowed", i)
+		}
+	}
+	if allow("192.0.2.1", "host3.example.com:443") {
+		t.Fatal("expected target over the limit to be denied")
+	}
+	if !allow("192.0.2.1", "host0.example.com:443") {
+		t.Fatal("expected known target to be allowed over the limit")
+	}
+	if !allow("192.0.2.2", "host3.example.com:443") {
+		t.Fatal("expected limits to be tracked per client")
+	}
+
+	// host0 was refreshed 30s after the others, so only it remains after a minute
+	now = now.Add(30 * time.Second)
+	allow("192.0.2.1", "host0.example.com:443")
+	now = now.Add(40 * time.Second)
+	for i := 3; i < 5; i++ {
+		if !allow("192.0.2.1", fmt.Sprintf("host%d.example.com:443", i)) {
+			t.Fatalf("expected target %d to be allowed once older targets expired", i)
+		}
+	}
+	if allow("192.0.2.1", "host5.example.com:443") {
+		t.Fatal("expected refreshed target to still count towards the limit")
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < dnsCachePurgeSize; i++ {
+		allow(fmt.Sprintf("client%d", i), "example.com:443")
+	}
+	if len(l.clients) > dnsCachePurgeSize {
+		t.Fatal("expected clients without live targets to be purged, got:", len(l.clients))
+	}
+}
+
+func TestMaxTargetsPerClient(t *testing.T) {
+	h := &Handler{logger: zap.NewNop(), targetLimiter: newTargetLimiter(1, time.Minute)}
+	h.targetLimiter.record("192.0.2.1", "example.com:443")
+
+	r := newTestRequest(http.MethodConnect, "caddyserver.com:443")
+	err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("expected tunnel to a new target over the limit to be rejected with 429, got:", err)
+	}
+}
+
+func TestMaxTargetsPerClientRejected(t *testing.T) {
+	h := &Handler{
+		logger:        zap.NewNop(),
+		targetLimiter: newTargetLimiter(1, time.Minute),
+		tunnelSlots:   make(chan struct{}, 1),
+	}
+	h.tunnelSlots <- struct{}{}
+
+	// rejected over the tunnel limit, so the target doesn't count
+	r := newTestRequest(http.MethodConnect, "caddyserver.com:443")
+	err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("expected tunnel over the tunnel limit to be rejected with 429, got:", err)
+	}
+	if n := len(h.targetLimiter.clients["192.0.2.1"]); n != 0 {
+		t.Fatal("expected rejected tunnel not to count towards the target limit, got targets:", n)
+	}
+
+	// rejected over the target limit, so the tunnel slot is freed
+	<-h.tunnelSlots
+	h.targetLimiter.record("192.0.2.1", "example.com:443")
+	err = h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("expected tunnel to a new target over the limit to be rejected with 429, got:", err)
+	}
+	if len(h.tunnelSlots) != 0 {
+		t.Fatal("expected tunnel slot of rejected tunnel to be freed")
+	}
+}
+
+func TestMaxTargetsPerClientDenied(t *testing.T) {
+	h := &Handler{
+		logger:        zap.NewNop(),
+		accessLogger:  zap.NewNop(),
+		targetLimiter: newTargetLimiter(1, time.Minute),
+		aclRules:      []aclRule{&aclAllRule{allow: false}},
+		resolver:      &countingResolver{},
+	}
+	r := newTestRequest(http.MethodConnect, "caddyserver.com:443")
+	r.ProtoMajor = 2
+	err := h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusForbidden {
+		t.Fatal("expected tunnel to be denied by ACL with 403, got:", err)
+	}
+	if n := len(h.targetLimiter.clients["192.0.2.1"]); n != 0 {
+		t.Fatal("expected tunnel denied by ACL not to count towards the target limit, got targets:", n)
+	}
+}